@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Number of unchanged lines shown around each hunk of a unified diff.
+const diffContext = 3
+
+// Kinds of line operations in a diff.
+const (
+	lineSame = ' '
+	lineDel  = '-'
+	lineAdd  = '+'
+)
+
+type lineOp struct {
+	kind byte
+	line string
+}
+
+// Returns a unified diff turning before into after, using the given names in
+// the header. It returns an empty string if before and after are the same.
+func unifiedDiff(beforeName, afterName, before, after string) string {
+	if before == after {
+		return ""
+	}
+	return fmt.Sprintf("--- %s\n+++ %s\n", beforeName, afterName) + diffHunks(before, after)
+}
+
+// Returns the hunks of a unified diff turning before into after, without the
+// header.
+func diffHunks(before, after string) string {
+	ops := diffLines(splitLines(before), splitLines(after))
+	var sb strings.Builder
+	for _, h := range hunks(ops) {
+		writeHunk(&sb, ops, h)
+	}
+	return sb.String()
+}
+
+// Splits s into lines, keeping the line terminators. The last line lacks a
+// terminator if s doesn't end with a newline.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Computes a shortest edit script turning a into b, using Myers' algorithm.
+func diffLines(a, b []string) []lineOp {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	// trace[d] is a copy of v after step d, used to recover the path.
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				trace = append(trace, append([]int(nil), v...))
+				return backtrack(a, b, trace, offset)
+			}
+		}
+		trace = append(trace, append([]int(nil), v...))
+	}
+	// Not reachable: d = n+m always suffices.
+	return nil
+}
+
+func backtrack(a, b []string, trace [][]int, offset int) []lineOp {
+	var ops []lineOp
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d-1]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, lineOp{lineSame, a[x]})
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, lineOp{lineAdd, b[y]})
+		} else {
+			x--
+			ops = append(ops, lineOp{lineDel, a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		ops = append(ops, lineOp{lineSame, a[x]})
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// A hunk is a range of ops, including surrounding context.
+type hunk struct {
+	from, to int
+}
+
+// Groups changed ops into hunks, merging hunks whose contexts overlap.
+func hunks(ops []lineOp) []hunk {
+	var hs []hunk
+	for i, op := range ops {
+		if op.kind == lineSame {
+			continue
+		}
+		from := i - diffContext
+		if from < 0 {
+			from = 0
+		}
+		to := i + 1 + diffContext
+		if to > len(ops) {
+			to = len(ops)
+		}
+		if len(hs) > 0 && from <= hs[len(hs)-1].to {
+			hs[len(hs)-1].to = to
+		} else {
+			hs = append(hs, hunk{from, to})
+		}
+	}
+	return hs
+}
+
+func writeHunk(sb *strings.Builder, ops []lineOp, h hunk) {
+	// Line numbers of the first line in the hunk, 1-based.
+	beforeLine, afterLine := 1, 1
+	for _, op := range ops[:h.from] {
+		if op.kind != lineAdd {
+			beforeLine++
+		}
+		if op.kind != lineDel {
+			afterLine++
+		}
+	}
+	beforeCount, afterCount := 0, 0
+	for _, op := range ops[h.from:h.to] {
+		if op.kind != lineAdd {
+			beforeCount++
+		}
+		if op.kind != lineDel {
+			afterCount++
+		}
+	}
+	// An empty range is denoted by the line before it.
+	if beforeCount == 0 {
+		beforeLine--
+	}
+	if afterCount == 0 {
+		afterLine--
+	}
+	fmt.Fprintf(sb, "@@ -%d,%d +%d,%d @@\n", beforeLine, beforeCount, afterLine, afterCount)
+	for _, op := range ops[h.from:h.to] {
+		sb.WriteByte(op.kind)
+		sb.WriteString(op.line)
+		if !strings.HasSuffix(op.line, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
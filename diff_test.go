@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Returns the lines joined with newlines, with a trailing newline.
+func lines(ls ...string) string {
+	return strings.Join(ls, "\n") + "\n"
+}
+
+var unifiedDiffTests = []struct {
+	name   string
+	before string
+	after  string
+	want   string
+}{
+	{
+		name:   "same",
+		before: "a\nb\n",
+		after:  "a\nb\n",
+		want:   "",
+	},
+	{
+		name:   "from empty file",
+		before: "",
+		after:  "a\n",
+		want:   "@@ -0,0 +1,1 @@\n+a\n",
+	},
+	{
+		name:   "to empty file",
+		before: "a\n",
+		after:  "",
+		want:   "@@ -1,1 +0,0 @@\n-a\n",
+	},
+	{
+		name:   "missing trailing newline",
+		before: "a\nb",
+		after:  "a\nc",
+		want: "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n" +
+			"+c\n\\ No newline at end of file\n",
+	},
+	{
+		name:   "adding trailing newline",
+		before: "a",
+		after:  "a\n",
+		want:   "@@ -1,1 +1,1 @@\n-a\n\\ No newline at end of file\n+a\n",
+	},
+	{
+		name:   "adjacent hunks merged",
+		before: lines("1", "2", "3", "4", "5", "6", "7", "8", "9", "10"),
+		after:  lines("1", "x", "3", "4", "5", "6", "7", "8", "y", "10"),
+		want:   "@@ -1,10 +1,10 @@\n 1\n-2\n+x\n 3\n 4\n 5\n 6\n 7\n 8\n-9\n+y\n 10\n",
+	},
+	{
+		name:   "distant hunks",
+		before: lines("1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12"),
+		after:  lines("1", "x", "3", "4", "5", "6", "7", "8", "9", "y", "11", "12"),
+		want: "@@ -1,5 +1,5 @@\n 1\n-2\n+x\n 3\n 4\n 5\n" +
+			"@@ -7,6 +7,6 @@\n 7\n 8\n 9\n-10\n+y\n 11\n 12\n",
+	},
+	{
+		name:   "pure insert",
+		before: lines("a", "b"),
+		after:  lines("a", "x", "b"),
+		want:   "@@ -1,2 +1,3 @@\n a\n+x\n b\n",
+	},
+	{
+		name:   "pure delete",
+		before: lines("a", "x", "b"),
+		after:  lines("a", "b"),
+		want:   "@@ -1,3 +1,2 @@\n a\n-x\n b\n",
+	},
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	for _, tc := range unifiedDiffTests {
+		t.Run(tc.name, func(t *testing.T) {
+			want := tc.want
+			if want != "" {
+				want = "--- a\n+++ b\n" + want
+			}
+			if got := unifiedDiff("a", "b", tc.before, tc.after); got != want {
+				t.Errorf("got diff\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package fix
+
+import (
+	"bufio"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+//go:generate go run ./internal/genbuiltins -o builtins/0.17.txt
+//go:generate go run ./internal/genbuiltins -release 0.13 -o builtins/0.13.txt
+//go:generate go run ./internal/genbuiltins -release 0.14 -o builtins/0.14.txt
+//go:generate go run ./internal/genbuiltins -release 0.15 -o builtins/0.15.txt
+//go:generate go run ./internal/genbuiltins -release 0.16 -o builtins/0.16.txt
+//go:generate go run ./internal/genbuiltins -release 0.18 -o builtins/0.18.txt
+
+// DefaultVersion is the Elvish version whose builtins are assumed when
+// Opts.Version is empty. Its snapshot is generated from the Elvish module this
+// module depends on; the snapshots of the other releases are derived from it
+// with the changes between the releases known to genbuiltins.
+const DefaultVersion = "0.17"
+
+// Snapshots of the names of the builtin variables of Elvish versions, one name
+// per line, with function variables having the "~" suffix, followed by the
+// special forms, like "special var". Lines starting with "#" are comments.
+//
+//go:embed builtins/*.txt
+var builtinSnapshots embed.FS
+
+// Builtin namespaces, keyed by version.
+var builtinNsByVersion = make(map[string]staticNs)
+
+// Names of the special forms, keyed by version.
+var specialsByVersion = make(map[string]map[string]bool)
+
+func init() {
+	files, err := builtinSnapshots.ReadDir("builtins")
+	if err != nil {
+		panic(err)
+	}
+	for _, file := range files {
+		data, err := builtinSnapshots.ReadFile(path.Join("builtins", file.Name()))
+		if err != nil {
+			panic(err)
+		}
+		version := strings.TrimSuffix(file.Name(), ".txt")
+		builtinNsByVersion[version], specialsByVersion[version] = parseBuiltinSnapshot(string(data))
+	}
+}
+
+func parseBuiltinSnapshot(data string) (staticNs, map[string]bool) {
+	ns := make(staticNs)
+	specials := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name := strings.TrimPrefix(line, "special "); name != line {
+			specials[name] = true
+		} else {
+			ns.add(line)
+		}
+	}
+	return ns, specials
+}
+
+// Versions returns the Elvish versions that can be used in Opts.Version,
+// sorted.
+func Versions() []string {
+	return sortedVersions(builtinNsByVersion)
+}
+
+// Returns the keys of the map, sorted by version.
+func sortedVersions(m map[string]staticNs) []string {
+	var versions []string
+	for version := range m {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versionLess(versions[i], versions[j]) })
+	return versions
+}
+
+// Returns the builtin namespace and special forms of the given version, or of
+// DefaultVersion if it is empty.
+func builtinsOf(version string) (staticNs, map[string]bool, error) {
+	if version == "" {
+		version = DefaultVersion
+	}
+	ns, ok := builtinNsByVersion[version]
+	if !ok {
+		return nil, nil, fmt.Errorf("no builtins known for Elvish version %q; known versions are %s",
+			version, strings.Join(Versions(), ", "))
+	}
+	return ns, specialsByVersion[version], nil
+}
@@ -0,0 +1,101 @@
+package fix
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Elvish releases in upgrade chains, oldest first. The last one is
+// DefaultVersion.
+var releases = []string{"0.13", "0.14", "0.15", "0.16", DefaultVersion}
+
+// Rules for the syntax changes introduced by each release. Only the changes of
+// 0.17 are known; the steps to earlier releases only apply the deprecated-command
+// and pattern rules, whose entries are keyed by the version.
+var releaseRules = map[string][]Rule{
+	"0.17": {RuleAssignVar, RuleAssignSet, RuleAssignMixed, RuleAssignSelf,
+		RuleBuggySet, RuleLegacyLambda, RuleTempAssign, RuleSource},
+}
+
+// Step is a step of an upgrade chain, which upgrades code written for an Elvish
+// release to the next one. Each step analyzes the code with the builtins of the
+// release it upgrades to.
+type Step struct {
+	From, To string
+	// The rules that make edits in this step.
+	Rules []Rule
+	// Only deprecated commands and pattern rules of versions newer than this,
+	// and not newer than To, apply in this step. If empty, all those not newer
+	// than To apply.
+	after string
+}
+
+// Releases returns the Elvish releases that Chain can upgrade code from,
+// oldest first.
+func Releases() []string {
+	return releases[:len(releases)-1]
+}
+
+// Chain returns the steps to upgrade code written for the given Elvish release
+// to DefaultVersion, in the order they should be applied. The deprecated
+// commands and pattern rules of versions up to from are applied in the first
+// step.
+func Chain(from string) ([]Step, error) {
+	i := 0
+	for i < len(releases)-1 && releases[i] != from {
+		i++
+	}
+	if i == len(releases)-1 {
+		return nil, fmt.Errorf("can't upgrade from Elvish version %q; known versions are %s",
+			from, strings.Join(Releases(), ", "))
+	}
+	var steps []Step
+	for ; i < len(releases)-1; i++ {
+		to := releases[i+1]
+		step := Step{From: releases[i], To: to,
+			Rules: append(releaseRules[to][:len(releaseRules[to]):len(releaseRules[to])],
+				RuleDeprecatedCommand, RulePattern)}
+		if len(steps) > 0 {
+			step.after = step.From
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// Opts returns the options to fix code with in this step, based on opts. The
+// rules not in the step are disabled, only the deprecated commands and pattern
+// rules of the releases in the step apply, and the builtins of s.To are
+// assumed.
+func (s Step) Opts(opts Opts) Opts {
+	disabled := make(map[Rule]bool)
+	for rule, ok := range opts.DisabledRules {
+		disabled[rule] = ok
+	}
+	inStep := make(map[Rule]bool)
+	for _, rule := range s.Rules {
+		inStep[rule] = true
+	}
+	for _, rule := range AllRules {
+		if !inStep[rule] {
+			disabled[rule] = true
+		}
+	}
+	opts.DisabledRules = disabled
+	opts.Version = s.To
+	opts.step = &s
+	return opts
+}
+
+// Returns whether the deprecated commands and pattern rules of the given
+// version apply with opts.
+func (opts Opts) appliesTo(version string) bool {
+	if s := opts.step; s != nil {
+		return (s.after == "" || versionLess(s.after, version)) && !versionLess(s.To, version)
+	}
+	target := opts.Version
+	if target == "" {
+		target = DefaultVersion
+	}
+	return !versionLess(target, version)
+}
@@ -0,0 +1,136 @@
+package fix
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Deprecation describes a deprecated command and its replacement, which takes
+// the same arguments.
+type Deprecation struct {
+	// The Elvish version that deprecated the command, like "0.17".
+	Version string
+	// The name of the command, like "float64" or "mod:old-name".
+	Name string
+	// The name of the replacement, like "num" or "str:join".
+	Replacement string
+	// The module to use for the namespace of the replacement, like
+	// "github.com/user/pkg/mod". If empty, it's the namespace itself, like
+	// "str" for "str:join".
+	Module string
+}
+
+// Namespace returns the namespace of the replacement with the ":" suffix, like
+// "str:", or an empty string if the replacement is unqualified.
+func (d Deprecation) Namespace() string {
+	if i := strings.LastIndexByte(d.Replacement, ':'); i != -1 {
+		return d.Replacement[:i+1]
+	}
+	return ""
+}
+
+// The module to use for the namespace of the replacement, or an empty string
+// if the replacement is unqualified.
+func (d Deprecation) module() string {
+	if d.Module != "" {
+		return d.Module
+	}
+	return strings.TrimSuffix(d.Namespace(), nsSuffix)
+}
+
+//go:embed deprecated.txt
+var builtinDeprecationTable string
+
+// Builtin commands deprecated by Elvish.
+var builtinDeprecations []Deprecation
+
+func init() {
+	var err error
+	builtinDeprecations, err = ParseDeprecations("deprecated.txt", builtinDeprecationTable)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ParseDeprecations parses a table of deprecated commands, like one to use in
+// Opts.Deprecations. Each line has the version that deprecated the command,
+// the command, its replacement, and optionally the module to use for the
+// replacement, separated by spaces, like:
+//
+//	0.17 float64 num
+//	1.2 mod:old-name mod:new-name github.com/user/pkg/mod
+//
+// Empty lines and lines starting with "#" are ignored. The name is used in
+// error messages.
+func ParseDeprecations(name, table string) ([]Deprecation, error) {
+	var deprecations []Deprecation
+	scanner := bufio.NewScanner(strings.NewReader(table))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, fmt.Errorf("%s:%d: want version, command, replacement and optionally module, got %d fields",
+				name, lineno, len(fields))
+		}
+		if _, ok := parseVersion(fields[0]); !ok {
+			return nil, fmt.Errorf("%s:%d: invalid version %q", name, lineno, fields[0])
+		}
+		d := Deprecation{Version: fields[0], Name: fields[1], Replacement: fields[2]}
+		if len(fields) == 4 {
+			if d.Namespace() == "" {
+				return nil, fmt.Errorf("%s:%d: module given for unqualified replacement %s",
+					name, lineno, d.Replacement)
+			}
+			d.Module = fields[3]
+		}
+		deprecations = append(deprecations, d)
+	}
+	return deprecations, nil
+}
+
+// Returns the deprecations of the builtin table and Opts.Deprecations that
+// apply with opts, keyed by the name of the command. Those in
+// Opts.Deprecations take precedence.
+func deprecationsOf(opts Opts) map[string]Deprecation {
+	m := make(map[string]Deprecation)
+	for _, table := range [][]Deprecation{builtinDeprecations, opts.Deprecations} {
+		for _, d := range table {
+			if opts.appliesTo(d.Version) {
+				m[d.Name] = d
+			}
+		}
+	}
+	return m
+}
+
+// Returns whether version a is older than version b. Versions that can't be
+// parsed are treated as older than all others.
+func versionLess(a, b string) bool {
+	va, _ := parseVersion(a)
+	vb, _ := parseVersion(b)
+	for i := 0; i < len(va) && i < len(vb); i++ {
+		if va[i] != vb[i] {
+			return va[i] < vb[i]
+		}
+	}
+	return len(va) < len(vb)
+}
+
+// Parses a version like "0.17" or "0.17.1" into its numbers.
+func parseVersion(s string) ([]int, bool) {
+	var numbers []int
+	for _, field := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, true
+}
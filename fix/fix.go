@@ -1,9 +1,11 @@
+// Package fix implements upgrading Elvish scripts to 0.17.
 package fix
 
 import (
 	"fmt"
 	"sort"
 	"strings"
+	"unicode/utf8"
 
 	"src.elv.sh/pkg/diag"
 	"src.elv.sh/pkg/parse"
@@ -21,89 +23,373 @@ type compiler struct {
 
 	// Builtin namespace.
 	builtin staticNs
+	// Special forms of the target version.
+	specials map[string]bool
 	// Lexical namespaces.
 	scopes []staticNs
 	// Information about the source.
 	srcMeta parse.Source
 
 	inserts []insert
-	deletes []diag.Ranging
+	deletes []deletion
+	// Number of rewrites started.
+	rewrites int
+	// Passes to run.
+	passes []Pass
+	// Compilation errors found so far.
+	errors []*diag.Error
+	// Watches of references in the right-hand sides of legacy assignment
+	// forms being compiled, innermost last.
+	refWatches []*refWatch
+	// Paths of the files being analyzed because they are sourced with
+	// -source, shared with the compilers analyzing them.
+	sourcing map[string]bool
+	// Deprecated commands that apply with opts, keyed by name, for
+	// deprecatedCommandPass.
+	deprecations map[string]Deprecation
+	// Pattern rules that apply with opts, keyed by the heads of their
+	// patterns, for patternPass and deprecatedCommandPass.
+	patternRules map[string][]*PatternRule
+	// Modules imported at the start of chunks so far, see importingRewrite.
+	imports []chunkImport
 }
 
 type insert struct {
 	pos  int
 	text string
+	// Whether the text starts a lambda that is not in the original code.
+	lambda bool
+	// Whether the insert goes before the other inserts at the same position,
+	// like an import at the start of a chunk.
+	first bool
+	rewriteInfo
 }
 
+type deletion struct {
+	diag.Ranging
+	rewriteInfo
+}
+
+// Identifies the rewrite an insert or deletion belongs to.
+type rewriteInfo struct {
+	rule   Rule
+	reason string
+	id     int
+}
+
+// Rule identifies a rule that produces edits.
+type Rule string
+
+// All the rules.
+const (
+	RuleAssignVar         Rule = "assign-var"
+	RuleAssignSet         Rule = "assign-set"
+	RuleAssignMixed       Rule = "assign-mixed"
+	RuleAssignSelf        Rule = "assign-self-ref"
+	RuleBuggySet          Rule = "buggy-set"
+	RuleLegacyLambda      Rule = "legacy-lambda"
+	RuleTempAssign        Rule = "temp-assign"
+	RuleSource            Rule = "source"
+	RuleDeprecatedCommand Rule = "deprecated-command"
+	RulePattern           Rule = "pattern"
+)
+
+// AllRules contains all the rules, in the order they are documented.
+var AllRules = []Rule{
+	RuleAssignVar, RuleAssignSet, RuleAssignMixed, RuleAssignSelf, RuleBuggySet, RuleLegacyLambda,
+	RuleTempAssign, RuleSource, RuleDeprecatedCommand,
+	RulePattern,
+}
+
+var ruleDescriptions = map[Rule]string{
+	RuleAssignVar:         "Rewrite legacy assignment forms that only declare new variables to var forms.",
+	RuleAssignSet:         "Rewrite legacy assignment forms that only assign existing variables to set forms.",
+	RuleAssignMixed:       "Rewrite legacy assignment forms that mix new and existing variables to var and set forms.",
+	RuleAssignSelf:        "Rewrite legacy assignment forms whose right-hand side refers to a new variable to var and set forms.",
+	RuleBuggySet:          "Declare variables created by the buggy set form of 0.15.x and 0.16.x with var first.",
+	RuleLegacyLambda:      "Rewrite lambdas with the legacy [...]{ ... } syntax to the new {|...| ... } syntax.",
+	RuleTempAssign:        "Rewrite temporary assignments like a=b cmd to the tmp command, like { tmp a = b; cmd }.",
+	RuleSource:            "Rewrite -source file to eval (slurp < file), copying the names the file defines back to the caller.",
+	RuleDeprecatedCommand: "Replace deprecated commands, like float64, with their replacements, like num.",
+	RulePattern:           "Apply the pattern rules given by the user.",
+}
+
+// Description returns a one-sentence description of the rule.
+func (r Rule) Description() string {
+	return ruleDescriptions[r]
+}
+
+// Edit is a change to the source code, replacing the text in a range with
+// Text. An empty range means inserting Text, and an empty Text means deleting
+// the range.
+type Edit struct {
+	diag.Ranging
+	Text string
+	// The rule that produced the edit.
+	Rule Rule
+	// A human-readable explanation of the rewrite the edit belongs to, like
+	// "legacy assignment declaring new variable $a; rewritten to var".
+	Reason string
+	// Edits belonging to the same rewrite have the same Rewrite number, and
+	// should be applied or skipped together. Rewrites are numbered from 0 in
+	// the order they appear in the source code.
+	Rewrite int
+	// Whether Text starts a lambda that the rewrite adds, like one wrapping a
+	// temporary assignment.
+	AddsLambda bool
+}
+
+// Opts controls which changes to make.
 type Opts struct {
-	MigrateLambda bool
+	// Rules whose edits are not made. Rules not in the map are enabled.
+	DisabledRules map[Rule]bool
+	// Passes to run. If nil, all the registered passes are run.
+	Passes []Pass
+	// The Elvish version whose builtins are assumed, like "0.17". If empty,
+	// DefaultVersion is used. See Versions for the supported versions.
+	Version string
+	// Reads files sourced with -source, to find the names they define. If nil,
+	// os.ReadFile is used, with a leading "~/" expanded to the home directory.
+	ReadFile func(name string) ([]byte, error)
+	// Deprecated commands to rewrite in addition to the builtin ones, like
+	// renames in the user's own modules. They take precedence over the
+	// builtin ones of the same names. See ParseDeprecations.
+	Deprecations []Deprecation
+	// Pattern rules to apply, which take precedence over the deprecated
+	// commands. See ParsePatternRules.
+	PatternRules []*PatternRule
+	// If true, source code with parse errors is still fixed, except for the
+	// top-level pipelines that overlap any parse error.
+	Tolerant bool
+
+	// The upgrade step being made, set by Step.Opts.
+	step *Step
 }
 
+// Fix returns the source code with all the edits returned by Edits applied. If
+// Edits returns an *Error, Fix returns the partially fixed source code along
+// with it.
 func Fix(src parse.Source, opts Opts) (string, error) {
-	t, err := parse.Parse(src, parse.Config{})
-	if err != nil {
+	edits, err := Edits(src, opts)
+	if err != nil && GetError(err) == nil {
 		return "", err
 	}
-	inserts, deletes, err := compile(builtinNs, t, opts)
+	return Apply(src.Code, edits), err
+}
+
+// Edits returns the edits needed to fix the source code, sorted by position.
+//
+// Forms that can't be analyzed are left unmodified, and analysis carries on
+// with the rest of the code. In that case, Edits returns the edits for the
+// rest of the code along with an *Error containing all the compilation errors.
+//
+// If the source code can't be parsed, Edits returns the parse error, unless
+// opts.Tolerant is true, in which case it returns the edits for the top-level
+// pipelines outside the parse errors, along with an *Error containing the
+// parse errors followed by any compilation errors.
+func Edits(src parse.Source, opts Opts) ([]Edit, error) {
+	builtin, specials, err := builtinsOf(opts.Version)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	// TODO: Apply replacement
-	return applyDiff(src.Code, inserts, deletes), nil
+	t, err := parse.Parse(src, parse.Config{})
+	var parseErrors []*diag.Error
+	if err != nil {
+		if !opts.Tolerant {
+			return nil, err
+		}
+		parseErrors = parse.GetError(err).Entries
+	}
+	inserts, deletes, err := compile(builtin, specials, t, parseErrors, opts)
+	edits := mergeDiff(inserts, deletes)
+	if verr := Validate(src.Code, edits); verr != nil {
+		return nil, verr
+	}
+	return edits, err
 }
 
-func applyDiff(s string, inserts []insert, deletes []diag.Ranging) string {
-	var sb strings.Builder
-	insertIdx := 0
-	deleteIdx := 0
-	for i, r := range s {
-		for insertIdx < len(inserts) && i == inserts[insertIdx].pos {
-			sb.WriteString(inserts[insertIdx].text)
-			insertIdx++
+// Merges sorted inserts and deletes into edits. Consecutive inserts at the same
+// position that belong to the same rewrite become one edit, and so do an insert
+// and a delete at the same position that belong to the same rewrite.
+func mergeDiff(inserts []insert, deletes []deletion) []Edit {
+	var merged []insert
+	for _, ins := range inserts {
+		if k := len(merged) - 1; k >= 0 && merged[k].pos == ins.pos && merged[k].rewriteInfo == ins.rewriteInfo {
+			merged[k].text += ins.text
+			merged[k].lambda = merged[k].lambda || ins.lambda
+			continue
 		}
-		if deleteIdx < len(deletes) && i == deletes[deleteIdx].To {
-			deleteIdx++
+		merged = append(merged, ins)
+	}
+	inserts = merged
+	var edits []Edit
+	// Maps rewrite IDs to rewrite numbers in the order they appear.
+	numbers := make(map[int]int)
+	add := func(r diag.Ranging, text string, lambda bool, rw rewriteInfo) {
+		n, ok := numbers[rw.id]
+		if !ok {
+			n = len(numbers)
+			numbers[rw.id] = n
 		}
-		if deleteIdx < len(deletes) && within(i, deletes[deleteIdx]) {
-			continue
+		edits = append(edits, Edit{r, text, rw.rule, rw.reason, n, lambda})
+	}
+	i, j := 0, 0
+	for i < len(inserts) || j < len(deletes) {
+		switch {
+		case j == len(deletes) || (i < len(inserts) && inserts[i].pos < deletes[j].From):
+			pos := inserts[i].pos
+			add(diag.Ranging{From: pos, To: pos}, inserts[i].text, inserts[i].lambda, inserts[i].rewriteInfo)
+			i++
+		case i == len(inserts) || deletes[j].From < inserts[i].pos:
+			add(deletes[j].Ranging, "", false, deletes[j].rewriteInfo)
+			j++
+		case inserts[i].rewriteInfo != deletes[j].rewriteInfo:
+			pos := inserts[i].pos
+			add(diag.Ranging{From: pos, To: pos}, inserts[i].text, inserts[i].lambda, inserts[i].rewriteInfo)
+			i++
+		default:
+			add(deletes[j].Ranging, inserts[i].text, inserts[i].lambda, inserts[i].rewriteInfo)
+			i++
+			j++
 		}
-		sb.WriteRune(r)
 	}
+	return edits
+}
+
+// Apply applies edits to the code. The edits must be valid as checked by
+// Validate, like those returned by Edits. A subset of the edits returned by
+// Edits can be applied as long as each rewrite is either fully applied or
+// skipped.
+func Apply(code string, edits []Edit) string {
+	var sb strings.Builder
+	last := 0
+	for _, edit := range edits {
+		sb.WriteString(code[last:edit.From])
+		sb.WriteString(edit.Text)
+		last = edit.To
+	}
+	sb.WriteString(code[last:])
 	return sb.String()
 }
 
-func within(i int, r diag.Ranging) bool {
-	return r.From <= i && i < r.To
+// Validate checks that the edits can be applied to the code: each edit must be
+// within the code, start and end on UTF-8 boundaries, and the edits must be
+// sorted by position and not overlap. Inserts at the same position are
+// applied in order. An insert at the start or end of a deleted range doesn't
+// overlap it.
+func Validate(code string, edits []Edit) error {
+	// The edit that ends last so far, and where it ends.
+	var last *Edit
+	end := 0
+	for i := range edits {
+		edit := &edits[i]
+		if edit.From < 0 || edit.From > edit.To || edit.To > len(code) {
+			return fmt.Errorf("edit of rule %s has invalid range %d-%d in code of %d bytes",
+				edit.Rule, edit.From, edit.To, len(code))
+		}
+		for _, pos := range []int{edit.From, edit.To} {
+			if pos < len(code) && !utf8.RuneStart(code[pos]) {
+				return fmt.Errorf("edit of rule %s at %d-%d is not on UTF-8 boundaries",
+					edit.Rule, edit.From, edit.To)
+			}
+		}
+		if i > 0 && edit.From < edits[i-1].From {
+			prev := edits[i-1]
+			return fmt.Errorf("edit of rule %s at %d-%d comes after edit of rule %s at %d-%d",
+				edit.Rule, edit.From, edit.To, prev.Rule, prev.From, prev.To)
+		}
+		if edit.From < end {
+			return fmt.Errorf("conflicting edits: edit of rule %s at %d-%d overlaps edit of rule %s at %d-%d",
+				edit.Rule, edit.From, edit.To, last.Rule, last.From, last.To)
+		}
+		if last == nil || edit.To >= end {
+			last, end = edit, edit.To
+		}
+	}
+	return nil
 }
 
-func compile(b staticNs, tree parse.Tree, opts Opts) (inserts []insert, deletes []diag.Ranging, err error) {
-	cp := &compiler{opts, b, []staticNs{makeStaticNs("edit:")}, tree.Source, nil, nil}
+// Compiles the tree, skipping the top-level pipelines that overlap any of the
+// given parse errors. The parse errors are included in the returned error.
+func compile(b staticNs, specials map[string]bool, tree parse.Tree, parseErrors []*diag.Error, opts Opts) (inserts []insert, deletes []deletion, err error) {
+	passes := opts.Passes
+	if passes == nil {
+		passes = registeredPasses
+	}
+	cp := &compiler{
+		opts: opts, builtin: b, specials: specials, scopes: []staticNs{makeStaticNs("edit:")},
+		srcMeta: tree.Source, passes: passes, sourcing: make(map[string]bool),
+		deprecations: deprecationsOf(opts), patternRules: patternRulesOf(opts)}
+	if len(parseErrors) == 0 {
+		cp.recovering(func() { cp.visit(tree.Root) })
+	} else {
+		for _, p := range tree.Root.Pipelines {
+			if !overlapsAny(p, parseErrors) {
+				cp.recovering(func() { cp.visit(p) })
+			}
+		}
+	}
+	if errors := append(parseErrors[:len(parseErrors):len(parseErrors)], cp.errors...); len(errors) > 0 {
+		err = &Error{errors}
+	}
+	// Inserts at the same position are kept in the order they are made,
+	// except those that go first.
+	sort.SliceStable(cp.inserts, func(i, j int) bool {
+		a, b := cp.inserts[i], cp.inserts[j]
+		return a.pos < b.pos || a.pos == b.pos && a.first && !b.first
+	})
+	sort.SliceStable(cp.deletes, func(i, j int) bool {
+		return cp.deletes[i].From < cp.deletes[j].From
+	})
+	return cp.inserts, cp.deletes, err
+}
+
+// Returns whether the node overlaps the range of any of the errors. An error
+// with an empty range overlaps the node if it is within or at either end of it.
+func overlapsAny(n parse.Node, errors []*diag.Error) bool {
+	r := n.Range()
+	for _, e := range errors {
+		from, to := e.Context.From, e.Context.To
+		if from == to && r.From <= from && from <= r.To ||
+			from < r.To && r.From < to {
+			return true
+		}
+	}
+	return false
+}
+
+// Calls f, recording the compilation error it raises, if any. The edits made
+// and scopes pushed by f are discarded when it raises an error, so that the
+// code it analyzes is left unmodified.
+func (cp *compiler) recovering(f func()) {
+	nInserts, nDeletes, nScopes := len(cp.inserts), len(cp.deletes), len(cp.scopes)
+	nWatches, nImports := len(cp.refWatches), len(cp.imports)
 	defer func() {
 		r := recover()
 		if r == nil {
 			return
-		} else if e := getCompilationError(r); e != nil {
-			// Save the compilation error and stop the panic.
-			err = e
-		} else {
+		}
+		e := getCompilationError(r)
+		if e == nil {
 			// Resume the panic; it is not supposed to be handled here.
 			panic(r)
 		}
+		cp.errors = append(cp.errors, e)
+		cp.inserts = cp.inserts[:nInserts]
+		cp.deletes = cp.deletes[:nDeletes]
+		for len(cp.scopes) > nScopes {
+			cp.popScope()
+		}
+		cp.refWatches = cp.refWatches[:nWatches]
+		cp.imports = cp.imports[:nImports]
 	}()
-	cp.visit(tree.Root)
-	sort.Slice(cp.inserts, func(i, j int) bool {
-		return cp.inserts[i].pos < cp.inserts[j].pos
-	})
-	sort.Slice(cp.deletes, func(i, j int) bool {
-		return cp.deletes[i].From < cp.deletes[j].From
-	})
-	return cp.inserts, cp.deletes, nil
+	f()
 }
 
 const compilationErrorType = "compilation error"
 
 func (cp *compiler) errorpf(r diag.Ranger, format string, args ...interface{}) {
-	// The panic is caught by the recover in compile above.
+	// The panic is caught by the recover in recovering above.
 	panic(&diag.Error{
 		Type:    compilationErrorType,
 		Message: fmt.Sprintf(format, args...),
@@ -119,58 +405,111 @@ func getCompilationError(e interface{}) *diag.Error {
 	return nil
 }
 
-func (cp *compiler) insert(pos int, text string) {
-	cp.inserts = append(cp.inserts, insert{pos, text})
+// Error stores all the errors found in a source file that is still partially
+// fixed: compilation errors, and parse errors when Opts.Tolerant is true.
+type Error struct {
+	Entries []*diag.Error
+}
+
+var _ diag.Shower = &Error{}
+
+// GetError returns an *Error if the given error has dynamic type *Error, i.e.
+// is returned by Edits or Fix for a partially fixed source file. Otherwise it
+// returns nil.
+func GetError(e error) *Error {
+	if er, ok := e.(*Error); ok {
+		return er
+	}
+	return nil
+}
+
+// Error returns a string representation of the error.
+func (er *Error) Error() string {
+	if len(er.Entries) == 1 {
+		return er.Entries[0].Error()
+	}
+	sb := new(strings.Builder)
+	fmt.Fprintf(sb, "multiple errors in %s: ", er.Entries[0].Context.Name)
+	for i, e := range er.Entries {
+		if i > 0 {
+			fmt.Fprint(sb, "; ")
+		}
+		fmt.Fprintf(sb, "%d-%d: %s", e.Context.From, e.Context.To, e.Message)
+	}
+	return sb.String()
+}
+
+// Show shows the error.
+func (er *Error) Show(indent string) string {
+	if len(er.Entries) == 1 {
+		return er.Entries[0].Show(indent)
+	}
+	sb := new(strings.Builder)
+	fmt.Fprint(sb, "Multiple errors:")
+	for _, e := range er.Entries {
+		sb.WriteString("\n" + indent + "  ")
+		fmt.Fprintf(sb, "\033[31;1m%s\033[m\n", e.Message)
+		sb.WriteString(indent + "    ")
+		sb.WriteString(e.Context.Show(indent + "      "))
+	}
+	return sb.String()
+}
+
+// rewriter records the inserts and deletes of one rewrite.
+type rewriter struct {
+	cp *compiler
+	rewriteInfo
+	// Whether the rule is disabled, in which case nothing is recorded.
+	disabled bool
 }
 
-func (cp *compiler) delete(from, to int) {
-	cp.deletes = append(cp.deletes, diag.Ranging{From: from, To: to})
+// Starts a new rewrite produced by the given rule, for the given reason.
+func (cp *compiler) rewrite(rule Rule, reason string) rewriter {
+	cp.rewrites++
+	return rewriter{cp, rewriteInfo{rule, reason, cp.rewrites}, cp.opts.DisabledRules[rule]}
+}
+
+func (rw rewriter) insert(pos int, text string, lambda bool) {
+	if !rw.disabled {
+		rw.cp.inserts = append(rw.cp.inserts, insert{pos, text, lambda, false, rw.rewriteInfo})
+	}
+}
+
+// Like insert, but the text goes before the other inserts at the same position.
+func (rw rewriter) insertFirst(pos int, text string) {
+	if !rw.disabled {
+		rw.cp.inserts = append(rw.cp.inserts, insert{pos, text, false, true, rw.rewriteInfo})
+	}
+}
+
+func (rw rewriter) delete(from, to int) {
+	if !rw.disabled {
+		rw.cp.deletes = append(rw.cp.deletes, deletion{diag.Ranging{From: from, To: to}, rw.rewriteInfo})
+	}
 }
 
 func (cp *compiler) thisScope() staticNs {
 	return cp.scopes[len(cp.scopes)-1]
 }
 
-func (cp *compiler) pushScope() staticNs {
-	sc := make(staticNs)
-	cp.scopes = append(cp.scopes, sc)
-	return sc
+func (cp *compiler) pushScope() {
+	cp.scopes = append(cp.scopes, make(staticNs))
+	cp.eachPass(func(p Pass, c *Context) { p.PushScope(c) })
 }
 
 func (cp *compiler) popScope() {
+	cp.eachPass(func(p Pass, c *Context) { p.PopScope(c) })
 	cp.scopes[len(cp.scopes)-1] = nil
 	cp.scopes = cp.scopes[:len(cp.scopes)-1]
 }
 
-type staticNs map[string]struct{}
+// Declares a variable in the current scope.
+func (cp *compiler) declare(name string) {
+	cp.thisScope().add(name)
+	cp.eachPass(func(p Pass, c *Context) { p.Declare(c, name) })
+}
 
-var builtinNs = makeStaticNs(
-	"!=s~", "!=~", "%~", "*~", "+~",
-	"-gc~", "-ifaddrs~", "-log~", "-override-wcwidth~", "-stack~",
-	"-~", "/~", "<=s~", "<=~", "<s~", "<~", "==s~", "==~", ">=s~", ">=~", ">s~", ">~",
-	"_",
-	"after-chdir", "all~", "args", "assoc~",
-	"base~", "before-chdir", "bool~", "break~", "buildinfo",
-	"cd~", "constantly~", "continue~", "count~",
-	"deprecate~", "dir-history~", "dissoc~", "drop~",
-	"each~", "eawk~", "echo~", "eq~", "eval~", "exact-num~", "exec~", "exit~", "external~",
-	"fail~", "false", "fg~", "float64~", "from-json~", "from-lines~", "from-terminated~",
-	"get-env~", "has-env~",
-	"has-external~", "has-key~", "has-value~",
-	"is~",
-	"keys~", "kind-of~",
-	"make-map~", "multi-error~",
-	"nil", "nop~", "not-eq~", "notify-bg-job-success", "not~", "ns~", "num-bg-jobs", "num~",
-	"ok",
-	"one~", "only-bytes~", "only-values~", "order~",
-	"paths", "peach~", "pid", "pprint~", "printf~", "print~", "put~", "pwd",
-	"randint~", "rand~", "range~", "read-line~", "read-upto~", "repeat~", "repr~", "resolve~", "return~", "run-parallel~",
-	"search-external~", "set-env~", "show~", "sleep~", "slurp~", "src~", "styled-segment~", "styled~",
-	"take~", "tilde-abbr~", "time~", "to-json~", "to-lines~", "to-string~", "to-terminated~", "true",
-	"unset-env~", "use-mod~",
-	"value-out-indicator", "version",
-	"wcswidth~",
-)
+type staticNs map[string]struct{}
 
 func (ns staticNs) del(k string) {
 	delete(ns, k)
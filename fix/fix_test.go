@@ -1,11 +1,72 @@
 package fix
 
 import (
+	"os"
+	"reflect"
+	"strings"
 	"testing"
 
+	"src.elv.sh/pkg/diag"
+	"src.elv.sh/pkg/eval"
 	"src.elv.sh/pkg/parse"
 )
 
+var (
+	noLambda = Opts{DisabledRules: map[Rule]bool{RuleLegacyLambda: true}}
+	noTemp   = Opts{DisabledRules: map[Rule]bool{RuleTempAssign: true}}
+	withTmp  = Opts{Version: "0.18"}
+	withLib  = Opts{ReadFile: fakeFiles(map[string]string{
+		"lib.elv":     "a = 1; fn f { }; -source inner.elv",
+		"mod.elv":     "use str; use re",
+		"inner.elv":   "b = 2",
+		"loop.elv":    "c = 3; -source loop.elv",
+		"bad.elv":     "del $a",
+		"dir/lib.elv": "e = 5",
+		"~/home.elv":  "d = 4",
+		"unparsable":  "put (",
+		"nothing.elv": "",
+	})}
+)
+
+var patternRules = mustParsePatternRules(`
+rule splits 0.14 builtin
+splits $sep $s -> str:split $sep $s
+example splits , a,b -> use str; str:split , a,b
+
+rule joins 0.17
+joins $sep $l -> my-join &sep=$sep $l
+
+rule each-rest 0.17
+each-all $f $@inputs -> each $f [$@inputs]
+
+rule same 0.17
+twice $x $x -> once $x
+
+rule opt 0.17
+h &k=$v $a -> h2 &k2=$v $a
+
+rule future 99.0
+put $x -> echo $x
+`)
+
+func mustParsePatternRules(text string) Opts {
+	rules, err := ParsePatternRules("rules", text)
+	if err != nil {
+		panic(err)
+	}
+	return Opts{PatternRules: rules}
+}
+
+// Returns a function to use as Opts.ReadFile, which reads from the given files.
+func fakeFiles(files map[string]string) func(string) ([]byte, error) {
+	return func(name string) ([]byte, error) {
+		if code, ok := files[name]; ok {
+			return []byte(code), nil
+		}
+		return nil, os.ErrNotExist
+	}
+}
+
 var fixTests = []struct {
 	name   string
 	before string
@@ -74,11 +135,13 @@ var fixTests = []struct {
 	},
 	{
 		name:   "set argument",
+		opts:   noLambda,
 		before: "fn f [a]{ a = foo }",
 		after:  "fn f [a]{ set a = foo }",
 	},
 	{
 		name:   "set option",
+		opts:   noLambda,
 		before: "fn f [&a=b]{ a = foo }",
 		after:  "fn f [&a=b]{ set a = foo }",
 	},
@@ -94,11 +157,13 @@ var fixTests = []struct {
 	},
 	{
 		name:   "set temp variable",
+		opts:   noTemp,
 		before: "a=b a = c",
 		after:  "a=b set a = c",
 	},
 	{
 		name:   "set leftover temp variable",
+		opts:   noTemp,
 		before: "a=b nop; a = c",
 		after:  "a=b nop; set a = c",
 	},
@@ -140,22 +205,305 @@ var fixTests = []struct {
 
 	{
 		name:   "legacy lambda",
-		opts:   Opts{MigrateLambda: true},
 		before: "fn f [a b &k=v]{ ... }",
 		after:  "fn f {|a b &k=v| ... }",
 	},
 	{
 		name:   "legacy lambda with empty arg list",
-		opts:   Opts{MigrateLambda: true},
 		before: "fn f []{ ... }",
 		after:  "fn f {|| ... }",
 	},
 	{
 		name:   "legacy lambda in temp assignment",
-		opts:   Opts{MigrateLambda: true},
+		opts:   noTemp,
 		before: "f=[a]{ ... } nop",
 		after:  "f={|a| ... } nop",
 	},
+	{
+		name:   "RHS referring to new variable in lambda",
+		before: "m = [&x={ put $m }]",
+		after:  "var m; set m = [&x={ put $m }]",
+	},
+	{
+		name:   "RHS referring to new variable in nested lambda",
+		before: "m = { { put $m } }",
+		after:  "var m; set m = { { put $m } }",
+	},
+	{
+		name:   "RHS calling new function",
+		before: "f~ = { f }",
+		after:  "var f~; set f~ = { f }",
+	},
+	{
+		name:   "RHS assigning new variable",
+		before: "m = { m = foo }",
+		after:  "var m; set m = { set m = foo }",
+	},
+	{
+		name:   "RHS referring to new variable with up:",
+		before: "fn f { m = { put $up:m } }",
+		after:  "fn f { var m; set m = { put $up:m } }",
+	},
+	{
+		name:   "RHS referring to new variable among existing ones",
+		before: "a = foo; a b = foo { put $b }",
+		after:  "var a = foo; var b; set a b = foo { put $b }",
+	},
+	{
+		name:   "RHS referring to shadowing argument",
+		before: "m = {|m| put $m }",
+		after:  "var m = {|m| put $m }",
+	},
+	{
+		name:   "RHS referring to local variable of lambda",
+		before: "m = { put $local:m }",
+		after:  "var m = { put $local:m }",
+	},
+	{
+		name:   "RHS referring to existing variable",
+		before: "m = foo; m = { put $m }",
+		after:  "var m = foo; set m = { put $m }",
+	},
+	{
+		name:   "temp assignment",
+		opts:   withTmp,
+		before: "E:FOO=x cmd a b",
+		after:  "{ tmp E:FOO = x; cmd a b }",
+	},
+	{
+		name:   "multiple temp assignments",
+		opts:   withTmp,
+		before: "E:A=x E:B=y cmd",
+		after:  "{ tmp E:A = x; tmp E:B = y; cmd }",
+	},
+	{
+		name:   "temp assignment to indexed variable",
+		opts:   withTmp,
+		before: "var m = [&]; m[k]=v cmd &opt=x >out",
+		after:  "var m = [&]; { tmp m[k] = v; cmd &opt=x >out }",
+	},
+	{
+		name:   "temp assignment in output capture",
+		opts:   withTmp,
+		before: "echo (E:A=x cmd)",
+		after:  "echo ({ tmp E:A = x; cmd })",
+	},
+	{
+		name:   "temp assignment in pipeline",
+		opts:   withTmp,
+		before: "x | E:A=x cmd | y",
+		after:  "x | { tmp E:A = x; cmd } | y",
+	},
+	{
+		name:   "temp assignment at the end of lambda",
+		opts:   withTmp,
+		before: "fn f { x; E:A=x cmd }",
+		after:  "fn f { x; tmp E:A = x; cmd }",
+	},
+	{
+		name:   "temp assignment not at the end of lambda",
+		opts:   withTmp,
+		before: "fn f { E:A=x cmd; x }",
+		after:  "fn f { { tmp E:A = x; cmd }; x }",
+	},
+	{
+		name:   "temp assignment to new variable",
+		opts:   withTmp,
+		before: "a=b nop; a = c",
+		after:  "var a; { tmp a = b; nop }; set a = c",
+	},
+	{
+		name:   "temp assignment with legacy lambda",
+		opts:   withTmp,
+		before: "f=[a]{ ... } nop",
+		after:  "var f; { tmp f = {|a| ... }; nop }",
+	},
+	{
+		name:   "temp assignment declaring at the end of lambda",
+		opts:   withTmp,
+		before: "fn f { E:A=b var c = $E:A }",
+		after:  "fn f { tmp E:A = b; var c = $E:A }",
+	},
+	{
+		name:   "temp assignment without tmp",
+		before: "E:FOO=x cmd a b",
+		after:  "E:FOO=x cmd a b",
+	},
+	{
+		name:   "source",
+		opts:   withLib,
+		before: "-source lib.elv; echo $a $b; f",
+		after: "var a b f~; eval &on-end={|ns| set a b f~ = $ns[a] $ns[b] $ns[f~] } (slurp < lib.elv); " +
+			"echo $a $b; f",
+	},
+	{
+		name:   "source defining existing variable",
+		opts:   withLib,
+		before: "var a; fn f { }; -source lib.elv; b = 3",
+		after:  "var a; fn f { }; var b; eval &on-end={|ns| set b = $ns[b] } (slurp < lib.elv); set b = 3",
+	},
+	{
+		name:   "source importing modules",
+		opts:   withLib,
+		before: "-source mod.elv; str:join , [a]",
+		after: "var re: str:; eval &on-end={|ns| set re: str: = $ns[re:] $ns[str:] } (slurp < mod.elv); " +
+			"str:join , [a]",
+	},
+	{
+		name:   "source importing module already imported",
+		opts:   withLib,
+		before: "use str; -source mod.elv",
+		after:  "use str; var re:; eval &on-end={|ns| set re: = $ns[re:] } (slurp < mod.elv)",
+	},
+	{
+		name:   "source in lambda",
+		opts:   withLib,
+		before: "fn g { -source inner.elv; b = 3 }",
+		after:  "fn g { var b; eval &on-end={|ns| set b = $ns[b] } (slurp < inner.elv); set b = 3 }",
+	},
+	{
+		name:   "source in pipeline",
+		opts:   withLib,
+		before: "-source nothing.elv | nop",
+		after:  "eval (slurp < nothing.elv) | nop",
+	},
+	{
+		name:   "source sourcing itself",
+		opts:   withLib,
+		before: "-source loop.elv",
+		after:  "var c; eval &on-end={|ns| set c = $ns[c] } (slurp < loop.elv)",
+	},
+	{
+		name:   "source with tilde",
+		opts:   withLib,
+		before: "-source ~/home.elv",
+		after:  "var d; eval &on-end={|ns| set d = $ns[d] } (slurp < ~/home.elv)",
+	},
+	{
+		name:   "source of file defining nothing",
+		opts:   withLib,
+		before: "-source nothing.elv",
+		after:  "eval (slurp < nothing.elv)",
+	},
+	{
+		name:   "source of unknown files with rule disabled",
+		opts:   Opts{DisabledRules: map[Rule]bool{RuleSource: true}, ReadFile: withLib.ReadFile},
+		before: "-source $p; -source nonexistent.elv; -source lib.elv; a = 2",
+		after:  "-source $p; -source nonexistent.elv; -source lib.elv; set a = 2",
+	},
+	{
+		name:   "source shadowed",
+		opts:   withLib,
+		before: "fn -source { }; -source lib.elv",
+		after:  "fn -source { }; -source lib.elv",
+	},
+	{
+		name:   "deprecated command",
+		before: "float64 1; put (float64 2)",
+		after:  "num 1; put (num 2)",
+	},
+	{
+		name:   "deprecated commands moved to module",
+		before: "a = 1; has-prefix a b; has-suffix a b | nop; fn f { has-suffix a b }",
+		after:  "use str; var a = 1; str:has-prefix a b; str:has-suffix a b | nop; fn f { str:has-suffix a b }",
+	},
+	{
+		name:   "deprecated commands moved to module in nested chunk first",
+		before: "fn f { has-prefix a b; has-suffix a b }; put (has-suffix a b)",
+		after:  "use str; fn f { use str; str:has-prefix a b; str:has-suffix a b }; put (str:has-suffix a b)",
+	},
+	{
+		name:   "deprecated command moved to module in scope",
+		before: "use str; joins , [a]",
+		after:  "use str; str:join , [a]",
+	},
+	{
+		name:   "deprecated command shadowed",
+		before: "fn float64 { }; float64 1; fn f { float64 2 }",
+		after:  "fn float64 { }; float64 1; fn f { float64 2 }",
+	},
+	{
+		name:   "deprecated command as variable",
+		before: "float64 = 1; put $float64",
+		after:  "var float64 = 1; put $float64",
+	},
+	{
+		name: "user deprecations",
+		opts: Opts{Deprecations: []Deprecation{
+			{"0.17", "mod:old", "mod:new", ""},
+			{"0.17", "float64", "my-num", ""},
+			{"0.17", "old-fn", "lib:new-fn", "github.com/user/lib"},
+			{"0.18", "put", "echo", ""},
+		}},
+		before: "use mod; mod:old; float64 1; old-fn; put x",
+		after:  "use github.com/user/lib; use mod; mod:new; my-num 1; lib:new-fn; put x",
+	},
+	{
+		name:   "pattern rule",
+		opts:   patternRules,
+		before: "splits , $x; fn f { splits , [a]{ } }",
+		after:  "use str; str:split , $x; fn f { str:split , {|a| } }",
+	},
+	{
+		name:   "pattern rule twice in a scope",
+		opts:   patternRules,
+		before: "fn f { splits , a; splits , b | nop }",
+		after:  "fn f { use str; str:split , a; str:split , b | nop }",
+	},
+	{
+		name:   "pattern rule with builtin condition",
+		opts:   patternRules,
+		before: "fn splits { }; splits , $x",
+		after:  "fn splits { }; splits , $x",
+	},
+	{
+		name:   "pattern rule over deprecated command",
+		opts:   patternRules,
+		before: "joins , [a]; joins , [a] > f",
+		after:  "use str; my-join &sep=, [a]; str:join , [a] > f",
+	},
+	{
+		name:   "pattern rule with rest",
+		opts:   patternRules,
+		before: "each-all $f a b; each-all $f",
+		after:  "each $f [a b]; each $f []",
+	},
+	{
+		name:   "pattern rule with repeated metavariable",
+		opts:   patternRules,
+		before: "twice a a; twice a b",
+		after:  "once a; twice a b",
+	},
+	{
+		name:   "pattern rule with options",
+		opts:   patternRules,
+		before: "h &k=1 x; h &k=1 &j=2 x; h x",
+		after:  "h2 &k2=1 x; h &k=1 &j=2 x; h x",
+	},
+	{
+		name:   "pattern rule for newer version",
+		opts:   patternRules,
+		before: "put x",
+		after:  "put x",
+	},
+	{
+		name:   "legacy lambda disabled",
+		opts:   noLambda,
+		before: "fn f [a]{ ... }",
+		after:  "fn f [a]{ ... }",
+	},
+	{
+		name:   "assignment rules disabled",
+		opts:   Opts{DisabledRules: map[Rule]bool{RuleAssignVar: true, RuleAssignSet: true}},
+		before: "a = foo; a = bar; a b = x y",
+		after:  "a = foo; a = bar; var b; set a b = x y",
+	},
+	{
+		name:   "buggy set disabled",
+		opts:   Opts{DisabledRules: map[Rule]bool{RuleBuggySet: true}},
+		before: "set a = foo; b = bar",
+		after:  "set a = foo; var b = bar",
+	},
 }
 
 func TestFix(t *testing.T) {
@@ -171,3 +519,778 @@ func TestFix(t *testing.T) {
 		})
 	}
 }
+
+const lambdaReason = "legacy lambda syntax; arguments and options moved into |...|"
+
+var editsTests = []struct {
+	name  string
+	code  string
+	opts  Opts
+	edits []Edit
+}{
+	{
+		name:  "no edits",
+		code:  "var a = foo",
+		edits: nil,
+	},
+	{
+		name:  "assign var",
+		code:  "local:a = foo",
+		edits: []Edit{{diag.Ranging{From: 0, To: 6}, "var ", RuleAssignVar, "legacy assignment declaring new variable $a; rewritten to var", 0, false}},
+	},
+	{
+		name: "assign var with multiple local:",
+		code: "local:a local:b = foo bar",
+		edits: []Edit{
+			{diag.Ranging{From: 0, To: 6}, "var ", RuleAssignVar, "legacy assignment declaring new variables $a $b; rewritten to var", 0, false},
+			{diag.Ranging{From: 8, To: 14}, "", RuleAssignVar, "legacy assignment declaring new variables $a $b; rewritten to var", 0, false},
+		},
+	},
+	{
+		name:  "assign set",
+		code:  "var a; a = foo",
+		edits: []Edit{{diag.Ranging{From: 7, To: 7}, "set ", RuleAssignSet, "legacy assignment to existing variable $a; rewritten to set", 0, false}},
+	},
+	{
+		name:  "assign mixed",
+		code:  "var a; a b = x y",
+		edits: []Edit{{diag.Ranging{From: 7, To: 7}, "var b; set ", RuleAssignMixed, "legacy assignment declaring new variable $b and assigning existing variable $a; rewritten to var and set", 0, false}},
+	},
+	{
+		name:  "buggy set",
+		code:  "set a = foo",
+		edits: []Edit{{diag.Ranging{From: 0, To: 0}, "var a; ", RuleBuggySet, "set creating new variable $a, which is not supported since 0.17; declared with var first", 0, false}},
+	},
+	{
+		name: "legacy lambda",
+		code: "fn f [a]{ }",
+		edits: []Edit{
+			{diag.Ranging{From: 5, To: 6}, "{|", RuleLegacyLambda, lambdaReason, 0, false},
+			{diag.Ranging{From: 7, To: 9}, "|", RuleLegacyLambda, lambdaReason, 0, false},
+		},
+	},
+	{
+		name: "nested legacy lambdas",
+		code: "fn f [&k=[x]{ }]{ }",
+		edits: []Edit{
+			{diag.Ranging{From: 5, To: 6}, "{|", RuleLegacyLambda, lambdaReason, 0, false},
+			{diag.Ranging{From: 9, To: 10}, "{|", RuleLegacyLambda, lambdaReason, 1, false},
+			{diag.Ranging{From: 11, To: 13}, "|", RuleLegacyLambda, lambdaReason, 1, false},
+			{diag.Ranging{From: 15, To: 17}, "|", RuleLegacyLambda, lambdaReason, 0, false},
+		},
+	},
+	{
+		name: "legacy lambda in legacy assignment",
+		code: "f = [x]{ }",
+		edits: []Edit{
+			{diag.Ranging{From: 0, To: 0}, "var ", RuleAssignVar, "legacy assignment declaring new variable $f; rewritten to var", 0, false},
+			{diag.Ranging{From: 4, To: 5}, "{|", RuleLegacyLambda, lambdaReason, 1, false},
+			{diag.Ranging{From: 6, To: 8}, "|", RuleLegacyLambda, lambdaReason, 1, false},
+		},
+	},
+	{
+		name: "source copying back names",
+		code: "-source a.elv",
+		opts: Opts{ReadFile: fakeFiles(map[string]string{"a.elv": "var a"})},
+		edits: []Edit{
+			{diag.Ranging{From: 0, To: 7}, "var a; eval &on-end={|ns| set a = $ns[a] }", RuleSource, "-source is removed in 0.17; rewritten to eval, copying back $a", 0, true},
+			{diag.Ranging{From: 8, To: 8}, "(slurp < ", RuleSource, "-source is removed in 0.17; rewritten to eval, copying back $a", 0, false},
+			{diag.Ranging{From: 13, To: 13}, ")", RuleSource, "-source is removed in 0.17; rewritten to eval, copying back $a", 0, false},
+		},
+	},
+}
+
+func TestEdits(t *testing.T) {
+	for _, tc := range editsTests {
+		t.Run(tc.name, func(t *testing.T) {
+			edits, err := Edits(parse.Source{Name: tc.name, Code: tc.code}, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(edits, tc.edits) {
+				t.Errorf("got edits %v, want %v", edits, tc.edits)
+			}
+		})
+	}
+}
+
+func TestApply_SubsetOfRewrites(t *testing.T) {
+	code := "f = [x]{ }"
+	edits, err := Edits(parse.Source{Name: "test", Code: code}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lambdaEdits []Edit
+	for _, edit := range edits {
+		if edit.Rule == RuleLegacyLambda {
+			lambdaEdits = append(lambdaEdits, edit)
+		}
+	}
+	if got, want := Apply(code, edits), "var f = {|x| }"; got != want {
+		t.Errorf("got %q from applying all edits, want %q", got, want)
+	}
+	if got, want := Apply(code, lambdaEdits), "f = {|x| }"; got != want {
+		t.Errorf("got %q from applying lambda edits, want %q", got, want)
+	}
+}
+
+var importingRewriteTests = []struct {
+	name    string
+	opts    Opts
+	code    string
+	rewrite int
+	want    string
+}{
+	{
+		name:    "deprecated commands",
+		code:    "float64 1; has-prefix a b; has-suffix a b",
+		rewrite: 0,
+		want:    "use str; float64 1; str:has-prefix a b; str:has-suffix a b",
+	},
+	{
+		name:    "deprecated command not importing",
+		code:    "float64 1; has-prefix a b; has-suffix a b",
+		rewrite: 1,
+		want:    "num 1; has-prefix a b; has-suffix a b",
+	},
+	{
+		name:    "deprecated commands in nested chunk",
+		code:    "fn f { has-prefix a b }; has-suffix a b",
+		rewrite: 1,
+		want:    "fn f { use str; str:has-prefix a b }; has-suffix a b",
+	},
+	{
+		name:    "pattern rule",
+		opts:    patternRules,
+		code:    "splits , a; splits , b",
+		rewrite: 0,
+		want:    "use str; str:split , a; str:split , b",
+	},
+	{
+		name:    "disabled rule",
+		opts:    Opts{DisabledRules: map[Rule]bool{RuleDeprecatedCommand: true}, PatternRules: patternRules.PatternRules},
+		code:    "has-prefix a b; splits , b",
+		rewrite: 0,
+		want:    "use str; has-prefix a b; str:split , b",
+	},
+}
+
+func TestApply_SubsetOfImportingRewrites(t *testing.T) {
+	for _, tc := range importingRewriteTests {
+		t.Run(tc.name, func(t *testing.T) {
+			edits, err := Edits(parse.Source{Name: "test", Code: tc.code}, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var subset []Edit
+			for _, edit := range edits {
+				if edit.Rewrite == tc.rewrite {
+					subset = append(subset, edit)
+				}
+			}
+			if got := Apply(tc.code, subset); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// A pass used in tests, which rewrites calls to the builtin echo to print.
+type echoToPrintPass struct{ NopPass }
+
+func (echoToPrintPass) Name() string { return "echo-to-print" }
+
+func (echoToPrintPass) Form(c *Context, n *parse.Form) {
+	if n.Head != nil && parse.SourceText(n.Head) == "echo" &&
+		c.LookupVar("echo~") == BuiltinScope {
+		c.Rewrite("echo-to-print", "echo is renamed").Replace(n.Head.From, n.Head.To, "print")
+	}
+}
+
+var customPassTests = []struct {
+	before string
+	after  string
+}{
+	{"echo foo", "print foo"},
+	{"{ echo foo }", "{ print foo }"},
+	{"fn echo { }; echo foo", "fn echo { }; echo foo"},
+	{"{|echo~| echo foo }", "{|echo~| echo foo }"},
+	// Built-in passes are not run when Opts.Passes is set.
+	{"a = foo", "a = foo"},
+}
+
+func TestFix_CustomPass(t *testing.T) {
+	for _, tc := range customPassTests {
+		after, err := Fix(parse.Source{Name: "test", Code: tc.before},
+			Opts{Passes: []Pass{echoToPrintPass{}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after != tc.after {
+			t.Errorf("got after %q, want %q", after, tc.after)
+		}
+	}
+}
+
+// A pass used in tests, which records scope events.
+type scopeEventsPass struct {
+	NopPass
+	events *[]string
+}
+
+func (scopeEventsPass) Name() string { return "scope-events" }
+
+func (p scopeEventsPass) PushScope(*Context) { *p.events = append(*p.events, "push") }
+func (p scopeEventsPass) PopScope(*Context)  { *p.events = append(*p.events, "pop") }
+func (p scopeEventsPass) Declare(c *Context, name string) {
+	*p.events = append(*p.events, "declare "+name)
+}
+
+func TestFix_ScopeEvents(t *testing.T) {
+	var events []string
+	_, err := Fix(parse.Source{Name: "test", Code: "var a; fn f {|b| var c }; use x"},
+		Opts{Passes: []Pass{scopeEventsPass{events: &events}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantEvents := []string{
+		"declare a", "declare f~", "push", "declare b", "declare c", "pop", "declare x:"}
+	if !reflect.DeepEqual(events, wantEvents) {
+		t.Errorf("got events %v, want %v", events, wantEvents)
+	}
+}
+
+var errorTests = []struct {
+	name       string
+	opts       Opts
+	before     string
+	after      string
+	wantErrors []string
+}{
+	{
+		name:       "rest of the code still fixed",
+		before:     "a = foo\nuse a b c\nb = bar",
+		after:      "var a = foo\nuse a b c\nvar b = bar",
+		wantErrors: []string{"superfluous argument(s)"},
+	},
+	{
+		name:       "all errors reported",
+		before:     "del $a\nb = foo\nuse\nb = bar",
+		after:      "del $a\nvar b = foo\nuse\nset b = bar",
+		wantErrors: []string{"arguments to del must drop $", "lack module name"},
+	},
+	{
+		name:       "edits inside the form with error discarded",
+		before:     "fn f [a]{ b = foo } extra",
+		after:      "fn f [a]{ b = foo } extra",
+		wantErrors: []string{"too many arguments"},
+	},
+	{
+		name:       "enclosing form still fixed",
+		before:     "f = { b = foo; del $c }",
+		after:      "var f = { var b = foo; del $c }",
+		wantErrors: []string{"arguments to del must drop $"},
+	},
+	{
+		name:       "temp assignment for var form",
+		opts:       withTmp,
+		before:     "a=b var c = 1; echo $c",
+		after:      "a=b var c = 1; echo $c",
+		wantErrors: []string{"temporary assignment for a form declaring variables; move the declaration out of the form"},
+	},
+	{
+		name:       "temp assignment for legacy assignment",
+		opts:       withTmp,
+		before:     "E:X=1 x = 2",
+		after:      "E:X=1 x = 2",
+		wantErrors: []string{"temporary assignment for a form declaring variables; move the declaration out of the form"},
+	},
+	{
+		name:       "tolerant parse errors",
+		opts:       Opts{Tolerant: true},
+		before:     "a = foo\necho $\nb = bar\necho \"\\q\" (c = x); d = y\nuse",
+		after:      "var a = foo\necho $\nvar b = bar\necho \"\\q\" (c = x); var d = y\nuse",
+		wantErrors: []string{"should be variable name", "invalid escape sequence", "lack module name"},
+	},
+	{
+		name:       "tolerant error at the end",
+		opts:       Opts{Tolerant: true},
+		before:     "a = foo\nb = (bar\n",
+		after:      "var a = foo\nb = (bar\n",
+		wantErrors: []string{"should be ')'"},
+	},
+	{
+		name:       "source defining variables in pipeline",
+		opts:       withLib,
+		before:     "-source inner.elv | nop; b = 3",
+		after:      "-source inner.elv | nop; var b = 3",
+		wantErrors: []string{"-source defining $b in a pipeline; source the file separately"},
+	},
+	{
+		name:   "source of unknown files",
+		opts:   withLib,
+		before: "-source $p; -source nonexistent.elv; -source bad.elv; -source unparsable",
+		after:  "-source $p; -source nonexistent.elv; -source bad.elv; -source unparsable",
+		wantErrors: []string{
+			"-source of a computed path; rewrite it to eval by hand, declaring the names the file defines",
+			"-source of a file that can't be analyzed (file does not exist); rewrite it to eval by hand, declaring the names the file defines",
+			"-source of a file that can't be analyzed (compilation error: 4-6 in bad.elv: arguments to del must drop $); rewrite it to eval by hand, declaring the names the file defines",
+			"-source of a file that can't be analyzed (parse error: 5-5 in unparsable: should be ')'); rewrite it to eval by hand, declaring the names the file defines",
+		},
+	},
+	{
+		name:       "pattern rule with options out of order",
+		opts:       patternRules,
+		before:     "h x &k=1",
+		after:      "h x &k=1",
+		wantErrors: []string{"can't apply pattern rule opt, since the options and arguments are not in the same order as in the pattern"},
+	},
+}
+
+// A pass used in tests, which raises an error for forms with a "fail"
+// argument.
+type failPass struct{ NopPass }
+
+func (failPass) Name() string { return "fail" }
+
+func (failPass) Form(c *Context, n *parse.Form) {
+	for _, arg := range n.Args {
+		if parse.SourceText(arg) == "fail" {
+			c.Errorf(arg, "fail")
+		}
+	}
+}
+
+func TestFix_ImportOfFailedFormDiscarded(t *testing.T) {
+	after, err := Fix(parse.Source{Name: "test", Code: "has-prefix a fail; has-suffix a b"},
+		Opts{Passes: []Pass{deprecatedCommandPass{}, failPass{}}})
+	if GetError(err) == nil {
+		t.Errorf("got error %v, want *Error", err)
+	}
+	if want := "use str; has-prefix a fail; str:has-suffix a b"; after != want {
+		t.Errorf("got %q, want %q", after, want)
+	}
+}
+
+func TestFix_CompilationErrors(t *testing.T) {
+	for _, tc := range errorTests {
+		t.Run(tc.name, func(t *testing.T) {
+			after, err := Fix(parse.Source{Name: tc.name, Code: tc.before}, tc.opts)
+			if after != tc.after {
+				t.Errorf("got code %q, want %q", after, tc.after)
+			}
+			fe := GetError(err)
+			if fe == nil {
+				t.Fatalf("got error %v, want *Error", err)
+			}
+			var messages []string
+			for _, e := range fe.Entries {
+				messages = append(messages, e.Message)
+			}
+			if !reflect.DeepEqual(messages, tc.wantErrors) {
+				t.Errorf("got errors %q, want %q", messages, tc.wantErrors)
+			}
+		})
+	}
+}
+
+func TestFix_ParseErrorNotTolerant(t *testing.T) {
+	_, err := Fix(parse.Source{Name: "test", Code: "a = foo\necho $"}, Opts{})
+	if parse.GetError(err) == nil {
+		t.Errorf("got error %v, want parse error", err)
+	}
+}
+
+// A pass used in tests, which replaces the head of each form with the given
+// text, and inserts a newline at the end of the code if it is missing.
+type replaceHeadPass struct {
+	NopPass
+	rule Rule
+	text string
+}
+
+func (p replaceHeadPass) Name() string { return string(p.rule) }
+
+func (p replaceHeadPass) Form(c *Context, n *parse.Form) {
+	if n.Head != nil {
+		c.Rewrite(p.rule, "test").Replace(n.Head.From, n.Head.To, p.text)
+	}
+	code := c.Source().Code
+	if n.To == len(code) && !strings.HasSuffix(code, "\n") {
+		c.Rewrite(p.rule, "test").Insert(len(code), "\n")
+	}
+}
+
+func TestFix_InsertAtEOF(t *testing.T) {
+	after, err := Fix(parse.Source{Name: "test", Code: "echo foo; echo bar"},
+		Opts{Passes: []Pass{replaceHeadPass{rule: "a", text: "print"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "print foo; print bar\n"; after != want {
+		t.Errorf("got after %q, want %q", after, want)
+	}
+}
+
+func TestFix_ConflictingPasses(t *testing.T) {
+	_, err := Fix(parse.Source{Name: "test", Code: "echo foo\n"},
+		Opts{Passes: []Pass{
+			replaceHeadPass{rule: "rule-a", text: "print"},
+			replaceHeadPass{rule: "rule-b", text: "put"}}})
+	if err == nil {
+		t.Fatal("got nil error, want error")
+	}
+	for _, rule := range []string{"rule-a", "rule-b"} {
+		if !strings.Contains(err.Error(), rule) {
+			t.Errorf("error %q doesn't mention %s", err, rule)
+		}
+	}
+}
+
+var validateTests = []struct {
+	name    string
+	code    string
+	edits   []Edit
+	wantErr bool
+}{
+	{"inserts at the same position", "ab", []Edit{
+		{diag.Ranging{From: 1, To: 1}, "x", "a", "", 0, false},
+		{diag.Ranging{From: 1, To: 1}, "y", "b", "", 1, false}}, false},
+	{"inserts at both ends of a deletion", "abc", []Edit{
+		{diag.Ranging{From: 1, To: 1}, "x", "a", "", 0, false},
+		{diag.Ranging{From: 1, To: 2}, "", "b", "", 1, false},
+		{diag.Ranging{From: 2, To: 2}, "y", "a", "", 2, false}}, false},
+	{"insert at EOF", "ab", []Edit{
+		{diag.Ranging{From: 2, To: 2}, "x", "a", "", 0, false}}, false},
+	{"out of bounds", "ab", []Edit{
+		{diag.Ranging{From: 1, To: 3}, "", "a", "", 0, false}}, true},
+	{"negative", "ab", []Edit{
+		{diag.Ranging{From: -1, To: 1}, "", "a", "", 0, false}}, true},
+	{"inside UTF-8 sequence", "αβ", []Edit{
+		{diag.Ranging{From: 1, To: 2}, "", "a", "", 0, false}}, true},
+	{"unsorted", "abc", []Edit{
+		{diag.Ranging{From: 2, To: 2}, "x", "a", "", 0, false},
+		{diag.Ranging{From: 1, To: 1}, "y", "b", "", 1, false}}, true},
+	{"overlapping deletions", "abcd", []Edit{
+		{diag.Ranging{From: 0, To: 2}, "", "a", "", 0, false},
+		{diag.Ranging{From: 1, To: 3}, "", "b", "", 1, false}}, true},
+	{"insert inside deletion", "abcd", []Edit{
+		{diag.Ranging{From: 0, To: 4}, "", "a", "", 0, false},
+		{diag.Ranging{From: 1, To: 3}, "", "b", "", 1, false},
+		{diag.Ranging{From: 3, To: 3}, "x", "c", "", 2, false}}, true},
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range validateTests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Validate(tc.code, tc.edits)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got error %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestFix_Idempotent(t *testing.T) {
+	for _, tc := range fixTests {
+		t.Run(tc.name, func(t *testing.T) {
+			again, err := Fix(parse.Source{Name: tc.name, Code: tc.after}, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again != tc.after {
+				t.Errorf("fixing %q again got %q", tc.after, again)
+			}
+		})
+	}
+}
+
+func TestBuiltinSnapshot_MatchesDependency(t *testing.T) {
+	want := make(staticNs)
+	eval.NewEvaler().Builtin().IterateNames(want.add)
+	wantSpecials := make(map[string]bool)
+	for name := range eval.IsBuiltinSpecial {
+		wantSpecials[name] = true
+	}
+	got, gotSpecials, err := builtinsOf(DefaultVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(gotSpecials, wantSpecials) {
+		t.Errorf("snapshot of %s differs from the builtins of src.elv.sh; run go generate", DefaultVersion)
+	}
+}
+
+func TestVersions_SortedByVersion(t *testing.T) {
+	m := map[string]staticNs{"0.17": nil, "0.9": nil, "0.10": nil, "1.0": nil}
+	if got, want := sortedVersions(m), []string{"0.9", "0.10", "0.17", "1.0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got versions %q, want %q", got, want)
+	}
+	if got, want := Versions(), []string{"0.13", "0.14", "0.15", "0.16", "0.17", "0.18"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got versions %q, want %q", got, want)
+	}
+}
+
+func TestEdits_VersionChoosesBuiltins(t *testing.T) {
+	for _, tc := range []struct{ version, after string }{
+		// esleep is deprecated in 0.15 and removed afterwards.
+		{"0.15", "set esleep~ = { }"},
+		{"0.17", "var esleep~ = { }"},
+	} {
+		got, err := Fix(parse.Source{Name: "test", Code: "esleep~ = { }"}, Opts{Version: tc.version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.after {
+			t.Errorf("with version %s got %q, want %q", tc.version, got, tc.after)
+		}
+	}
+}
+
+func TestEdits_UnknownVersion(t *testing.T) {
+	_, err := Edits(parse.Source{Name: "test", Code: "a = foo"}, Opts{Version: "0.1"})
+	if err == nil {
+		t.Errorf("got nil error, want error")
+	}
+}
+
+func TestFix_SourceRelativeToScript(t *testing.T) {
+	got, err := Fix(parse.Source{Name: "dir/script.elv", Code: "-source lib.elv; echo $e"}, withLib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "var e; eval &on-end={|ns| set e = $ns[e] } (slurp < lib.elv); echo $e"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFix_TempAssignmentToNewVariableInPipeline(t *testing.T) {
+	_, err := Fix(parse.Source{Name: "test", Code: "x | a=b cmd"}, withTmp)
+	if GetError(err) == nil {
+		t.Errorf("got error %v, want compilation error", err)
+	}
+}
+
+var parseDeprecationsTests = []struct {
+	name    string
+	table   string
+	want    []Deprecation
+	wantErr string
+}{
+	{
+		name:  "entries and comments",
+		table: "# comment\n\n0.17 float64 num\n 1.2.3  a:old  a:new  github.com/user/a \n",
+		want: []Deprecation{
+			{"0.17", "float64", "num", ""},
+			{"1.2.3", "a:old", "a:new", "github.com/user/a"},
+		},
+	},
+	{
+		name:    "too few fields",
+		table:   "0.17 float64 num\n0.17 foo\n",
+		wantErr: "table:2: want version, command, replacement and optionally module, got 2 fields",
+	},
+	{
+		name:    "invalid version",
+		table:   "v0.17 float64 num",
+		wantErr: `table:1: invalid version "v0.17"`,
+	},
+	{
+		name:    "module for unqualified replacement",
+		table:   "0.17 float64 num mod",
+		wantErr: "table:1: module given for unqualified replacement num",
+	},
+}
+
+func TestParseDeprecations(t *testing.T) {
+	for _, tc := range parseDeprecationsTests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseDeprecations("table", tc.table)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Errorf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+var parsePatternRulesTests = []struct {
+	name    string
+	text    string
+	wantErr string
+}{
+	{
+		name:    "pattern without rule",
+		text:    "a $x -> b $x",
+		wantErr: "rules:1: pattern must follow a rule line",
+	},
+	{
+		name:    "rule without pattern",
+		text:    "rule a 0.17\nrule b 0.17\nb -> c",
+		wantErr: "rules:2: rule a has no pattern",
+	},
+	{
+		name:    "rule without pattern at the end",
+		text:    "rule a 0.17",
+		wantErr: "rules: rule a has no pattern",
+	},
+	{
+		name:    "invalid rule line",
+		text:    "rule a 0.17 local",
+		wantErr: "rules:1: want rule name, version and optionally builtin",
+	},
+	{
+		name:    "example without pattern",
+		text:    "rule a 0.17\nexample a -> b",
+		wantErr: "rules:2: example must follow the pattern of a rule",
+	},
+	{
+		name:    "no arrow",
+		text:    "rule a 0.17\na $x b $x",
+		wantErr: "rules:2: want pattern and replacement separated by ->",
+	},
+	{
+		name:    "invalid version",
+		text:    "rule a latest\na -> b",
+		wantErr: `rules:2: rule a: invalid version "latest"`,
+	},
+	{
+		name:    "more than one form",
+		text:    "rule a 0.17\na; b -> c",
+		wantErr: "rules:2: rule a: pattern must be a single form",
+	},
+	{
+		name:    "non-literal head",
+		text:    "rule a 0.17\n$f $x -> g $x",
+		wantErr: "rules:2: rule a: head of pattern must be a string literal",
+	},
+	{
+		name:    "rest not last",
+		text:    "rule a 0.17\na $@x $y -> b $@x $y",
+		wantErr: "rules:2: rule a: $@x must be the last argument of pattern",
+	},
+	{
+		name:    "metavariable unused",
+		text:    "rule a 0.17\na $x $y -> b $x",
+		wantErr: "rules:2: rule a: replacement must use each metavariable of pattern exactly once",
+	},
+	{
+		name:    "metavariables reordered",
+		text:    "rule a 0.17\na $x $y -> b $y $x",
+		wantErr: "rules:2: rule a: replacement must use the metavariables in the same order as pattern",
+	},
+}
+
+func TestParsePatternRules(t *testing.T) {
+	for _, tc := range parsePatternRulesTests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParsePatternRules("rules", tc.text)
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPatternRule_CheckExamples(t *testing.T) {
+	r := patternRules.PatternRules[0]
+	if err := r.CheckExamples(Opts{}); err != nil {
+		t.Error(err)
+	}
+	bad := *r
+	bad.Examples = []PatternExample{{"splits , a", "str:split , a"}}
+	wantErr := `rule splits: example 1: got "use str; str:split , a", want "str:split , a"`
+	if err := bad.CheckExamples(Opts{}); err == nil || err.Error() != wantErr {
+		t.Errorf("got error %v, want %q", err, wantErr)
+	}
+}
+
+var chainTests = []struct {
+	name   string
+	from   string
+	before string
+	// The code after each step.
+	after []string
+}{
+	{
+		name:   "from 0.14",
+		from:   "0.14",
+		before: "a = (has-prefix a b); esleep 1; f = [x]{ float64 $x }",
+		after: []string{
+			"use str; a = (str:has-prefix a b); sleep 1; f = [x]{ float64 $x }",
+			"use str; a = (str:has-prefix a b); sleep 1; f = [x]{ float64 $x }",
+			"use str; var a = (str:has-prefix a b); sleep 1; var f = {|x| num $x }",
+		},
+	},
+	{
+		name:   "from 0.16",
+		from:   "0.16",
+		before: "a = (has-prefix a b); esleep 1",
+		after:  []string{"use str; var a = (str:has-prefix a b); sleep 1"},
+	},
+}
+
+func TestChain(t *testing.T) {
+	for _, tc := range chainTests {
+		t.Run(tc.name, func(t *testing.T) {
+			steps, err := Chain(tc.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(steps) != len(tc.after) {
+				t.Fatalf("got %d steps, want %d", len(steps), len(tc.after))
+			}
+			if steps[0].From != tc.from || steps[len(steps)-1].To != DefaultVersion {
+				t.Errorf("got steps from %s to %s, want from %s to %s",
+					steps[0].From, steps[len(steps)-1].To, tc.from, DefaultVersion)
+			}
+			code := tc.before
+			for i, step := range steps {
+				code, err = Fix(parse.Source{Name: tc.name, Code: code}, step.Opts(Opts{}))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if code != tc.after[i] {
+					t.Errorf("got %q after step to %s, want %q", code, step.To, tc.after[i])
+				}
+			}
+		})
+	}
+}
+
+func TestChain_UnknownVersion(t *testing.T) {
+	for _, from := range []string{"0.12", DefaultVersion, ""} {
+		if _, err := Chain(from); err == nil {
+			t.Errorf("Chain(%q) got nil error, want error", from)
+		}
+	}
+}
+
+func TestStep_OptsKeepsDisabledRules(t *testing.T) {
+	steps, _ := Chain("0.16")
+	opts := Opts{DisabledRules: map[Rule]bool{RuleAssignVar: true}}
+	stepOpts := steps[0].Opts(opts)
+	if !stepOpts.DisabledRules[RuleAssignVar] || stepOpts.DisabledRules[RuleAssignSet] {
+		t.Errorf("got disabled rules %v, want only %s", stepOpts.DisabledRules, RuleAssignVar)
+	}
+	if len(opts.DisabledRules) != 1 {
+		t.Errorf("opts.DisabledRules modified to %v", opts.DisabledRules)
+	}
+}
+
+func TestStep_OptsUsesBuiltinsOfRelease(t *testing.T) {
+	steps, _ := Chain("0.14")
+	for _, step := range steps {
+		if got := step.Opts(Opts{Version: "0.13"}).Version; got != step.To {
+			t.Errorf("got version %q for step to %s, want %q", got, step.To, step.To)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Command genbuiltins writes the names of the builtin variables and special
+// forms of an Elvish release, to be embedded as a snapshot by the fix package.
+//
+// The snapshot of fix.DefaultVersion is generated from the Elvish module this
+// module depends on. Snapshots of other releases are derived from it by
+// undoing or applying the changes between the releases: the deprecated
+// commands in the fix package's table, and the changes in releaseChanges.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/elves/upgrade-scripts-for-0.17/fix"
+	"src.elv.sh/pkg/eval"
+)
+
+var (
+	output       = flag.String("o", "", "file to write; stdout if empty")
+	release      = flag.String("release", fix.DefaultVersion, "Elvish release to write the snapshot of")
+	deprecations = flag.String("deprecations", "deprecated.txt", "table of deprecated commands of the fix package")
+)
+
+// Changes to the builtins that the table of deprecated commands doesn't
+// record, keyed by the release making them. Special forms have the "special "
+// prefix, like in the snapshots.
+var releaseChanges = []struct {
+	version        string
+	added, removed []string
+}{
+	{"0.16", []string{"special var", "special set"}, nil},
+	{"0.17", []string{"special coalesce", "special pragma"}, []string{"-source~"}},
+	{"0.18", []string{"special tmp"}, nil},
+}
+
+func main() {
+	flag.Parse()
+	names := make(map[string]bool)
+	eval.NewEvaler().Builtin().IterateNames(func(name string) {
+		names[name] = true
+	})
+	for name := range eval.IsBuiltinSpecial {
+		names["special "+name] = true
+	}
+
+	header := fmt.Sprintf("# Builtin variables and special forms of Elvish, generated by genbuiltins\n# from src.elv.sh %s. DO NOT EDIT.\n", elvishVersion())
+	if *release != fix.DefaultVersion {
+		table, err := os.ReadFile(*deprecations)
+		if err != nil {
+			exit(err)
+		}
+		ds, err := fix.ParseDeprecations(*deprecations, string(table))
+		if err != nil {
+			exit(err)
+		}
+		derive(names, *release, ds)
+		header = fmt.Sprintf("# Builtin variables and special forms of Elvish %s, derived by genbuiltins\n# from src.elv.sh %s\n# with the changes between the releases it knows. DO NOT EDIT.\n", *release, elvishVersion())
+	}
+
+	var builtins, specials []string
+	for name := range names {
+		if special := strings.TrimPrefix(name, "special "); special != name {
+			specials = append(specials, special)
+		} else {
+			builtins = append(builtins, name)
+		}
+	}
+	sort.Strings(builtins)
+	sort.Strings(specials)
+	var sb strings.Builder
+	sb.WriteString(header)
+	for _, name := range builtins {
+		sb.WriteString(name + "\n")
+	}
+	for _, name := range specials {
+		sb.WriteString("special " + name + "\n")
+	}
+	if *output == "" {
+		fmt.Print(sb.String())
+		return
+	}
+	if err := os.WriteFile(*output, []byte(sb.String()), 0644); err != nil {
+		exit(err)
+	}
+}
+
+// Turns the names of the builtins of fix.DefaultVersion into those of the
+// given release. A deprecated command exists up to the release deprecating it,
+// and an unqualified replacement from that release on.
+func derive(names map[string]bool, release string, ds []fix.Deprecation) {
+	base := fix.DefaultVersion
+	for _, c := range releaseChanges {
+		switch {
+		case versionLess(base, c.version) && !versionLess(release, c.version):
+			// Made after the base release, up to this one.
+			setAll(names, c.added, true)
+			setAll(names, c.removed, false)
+		case versionLess(release, c.version) && !versionLess(base, c.version):
+			// Made after this release, up to the base one.
+			setAll(names, c.added, false)
+			setAll(names, c.removed, true)
+		}
+	}
+	for _, d := range ds {
+		if !strings.Contains(d.Name, ":") {
+			names[d.Name+"~"] = !versionLess(d.Version, release)
+		}
+		if !strings.Contains(d.Replacement, ":") {
+			names[d.Replacement+"~"] = !versionLess(release, d.Version)
+		}
+	}
+	for name, ok := range names {
+		if !ok {
+			delete(names, name)
+		}
+	}
+}
+
+func setAll(names map[string]bool, list []string, value bool) {
+	for _, name := range list {
+		names[name] = value
+	}
+}
+
+// Compares versions like "0.17" numerically.
+func versionLess(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			return x < y
+		}
+	}
+	return len(as) < len(bs)
+}
+
+func exit(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// Returns the version of the src.elv.sh module.
+func elvishVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "src.elv.sh" {
+				return dep.Version
+			}
+		}
+	}
+	return "(unknown version)"
+}
@@ -0,0 +1,198 @@
+package fix
+
+import (
+	"src.elv.sh/pkg/diag"
+	"src.elv.sh/pkg/parse"
+)
+
+// Pass is a migration pass. While walking the parse tree, the compiler tracks
+// the variables in scope and calls the methods of each pass, which may emit
+// edits through the Context.
+//
+// Implementations should embed NopPass, so that they only need to implement the
+// methods they are interested in.
+type Pass interface {
+	// Name returns the name of the pass.
+	Name() string
+	// Form is called for each form before the compiler analyzes it.
+	Form(c *Context, n *parse.Form)
+	// LegacyAssignment is called for each legacy assignment form, like "a b =
+	// foo bar", after the compiler has analyzed the whole form.
+	LegacyAssignment(c *Context, n *parse.Form, lvalues []LValue)
+	// Set is called for each set form after the compiler has analyzed its
+	// left-hand side.
+	Set(c *Context, n *parse.Form, lvalues []LValue)
+	// Primary is called for each primary expression, including lambdas,
+	// before visiting its children.
+	Primary(c *Context, n *parse.Primary)
+	// Lambda is called for each lambda before the compiler analyzes its
+	// signature and pushes its scope.
+	Lambda(c *Context, n *parse.Primary)
+	// PushScope is called when the compiler enters a new scope.
+	PushScope(c *Context)
+	// PopScope is called when the compiler leaves a scope.
+	PopScope(c *Context)
+	// Declare is called when a variable is declared in the current scope. The
+	// name includes the suffix of function and namespace variables, like "f~"
+	// and "ns:".
+	Declare(c *Context, name string)
+}
+
+// NopPass implements all the methods of Pass except Name as no-ops.
+type NopPass struct{}
+
+func (NopPass) Form(*Context, *parse.Form)                       {}
+func (NopPass) LegacyAssignment(*Context, *parse.Form, []LValue) {}
+func (NopPass) Set(*Context, *parse.Form, []LValue)              {}
+func (NopPass) Primary(*Context, *parse.Primary)                 {}
+func (NopPass) Lambda(*Context, *parse.Primary)                  {}
+func (NopPass) PushScope(*Context)                               {}
+func (NopPass) PopScope(*Context)                                {}
+func (NopPass) Declare(*Context, string)                         {}
+
+var registeredPasses []Pass
+
+// Register registers a pass, which is run by Edits and Fix unless Opts.Passes
+// is set. Passes run in the order they are registered. Register is not safe
+// for concurrent use, and should be called from init functions.
+func Register(p Pass) {
+	registeredPasses = append(registeredPasses, p)
+}
+
+// RegisteredPasses returns all the registered passes. The built-in passes are
+// registered first.
+func RegisteredPasses() []Pass {
+	return append([]Pass(nil), registeredPasses...)
+}
+
+func init() {
+	Register(legacyAssignmentPass{})
+	Register(legacyLambdaPass{})
+	Register(tempAssignmentPass{})
+	Register(sourcePass{})
+	Register(deprecatedCommandPass{})
+	Register(patternPass{})
+}
+
+// LValue is a variable assigned by a form.
+type LValue struct {
+	diag.Ranging
+	// Source text of the lvalue, like "a", "@a" or "a[0]".
+	Source string
+	// If the variable doesn't exist yet and is declared by the form, its name
+	// without any sigil or "local:" prefix. Empty otherwise.
+	NewName string
+	// Whether the variable is new and the right-hand side of a legacy
+	// assignment form refers to it, for example in a lambda.
+	UsedInRHS bool
+}
+
+// VarScope is where a variable is found.
+type VarScope int
+
+// Possible values of VarScope.
+const (
+	// The variable is not found.
+	NoScope VarScope = iota
+	// The variable is in the local scope.
+	LocalScope
+	// The variable is in an outer scope.
+	CaptureScope
+	// The variable is builtin, or in a special namespace like E:.
+	BuiltinScope
+)
+
+// Context gives a pass access to the state of the compiler.
+type Context struct {
+	cp *compiler
+}
+
+// Source returns the source code being compiled.
+func (c *Context) Source() parse.Source {
+	return c.cp.srcMeta
+}
+
+// Opts returns the options passed to Edits or Fix.
+func (c *Context) Opts() Opts {
+	return c.cp.opts
+}
+
+// LookupVar returns where the variable with the given qualified name, like
+// "a", "f~" or "ns:a", is found.
+func (c *Context) LookupVar(qname string) VarScope {
+	if ref := resolveVarRef(c.cp, qname, nil); ref != nil {
+		return ref.scope
+	}
+	return NoScope
+}
+
+// Declare declares a variable in the current scope, if it is not declared there
+// yet, for code that defines variables in ways the compiler doesn't know. The
+// name includes the suffix of function and namespace variables, like "f~" and
+// "ns:".
+func (c *Context) Declare(name string) {
+	if !c.cp.thisScope().has(name) {
+		c.cp.declare(name)
+	}
+}
+
+// HasSpecial returns whether the target version of Elvish has the special form
+// with the given name.
+func (c *Context) HasSpecial(name string) bool {
+	return c.cp.specials[name]
+}
+
+// Errorf stops analyzing the current form with an error about the given range.
+// The form is left unmodified, and the error is reported by Edits and Fix.
+func (c *Context) Errorf(r diag.Ranger, format string, args ...interface{}) {
+	c.cp.errorpf(r, format, args...)
+}
+
+// Rewrite starts a new rewrite produced by the given rule, for the given
+// reason. All the edits of a rewrite should be made with the returned
+// Rewriter. If the rule is in Opts.DisabledRules, the edits are dropped.
+func (c *Context) Rewrite(rule Rule, reason string) *Rewriter {
+	return &Rewriter{c.cp.rewrite(rule, reason)}
+}
+
+// Rewriter makes the edits of one rewrite.
+type Rewriter struct {
+	rw rewriter
+}
+
+// Insert inserts text at a position.
+func (r *Rewriter) Insert(pos int, text string) {
+	r.rw.insert(pos, text, false)
+}
+
+// InsertLambda is like Insert, but for text that starts a lambda not in the
+// original code. The edit is marked with Edit.AddsLambda.
+func (r *Rewriter) InsertLambda(pos int, text string) {
+	r.rw.insert(pos, text, true)
+}
+
+// Delete deletes the text in a range.
+func (r *Rewriter) Delete(from, to int) {
+	r.rw.delete(from, to)
+}
+
+// Replace replaces the text in a range.
+func (r *Rewriter) Replace(from, to int, text string) {
+	r.rw.delete(from, to)
+	r.rw.insert(from, text, false)
+}
+
+// ReplaceLambda is like Replace, but for text that starts a lambda not in the
+// original code. The edit is marked with Edit.AddsLambda.
+func (r *Rewriter) ReplaceLambda(from, to int, text string) {
+	r.rw.delete(from, to)
+	r.rw.insert(from, text, true)
+}
+
+// Calls f with each pass and its context.
+func (cp *compiler) eachPass(f func(Pass, *Context)) {
+	c := &Context{cp}
+	for _, p := range cp.passes {
+		f(p, c)
+	}
+}
@@ -0,0 +1,103 @@
+package fix
+
+import (
+	"strings"
+
+	"src.elv.sh/pkg/parse"
+)
+
+// legacyAssignmentPass rewrites legacy assignment forms to var and set forms,
+// and fixes uses of the buggy set form that create new variables.
+type legacyAssignmentPass struct{ NopPass }
+
+func (legacyAssignmentPass) Name() string { return "legacy-assignment" }
+
+func (legacyAssignmentPass) LegacyAssignment(c *Context, n *parse.Form, lvalues []LValue) {
+	newNames, usedInRHS := 0, 0
+	for _, lv := range lvalues {
+		if lv.NewName != "" {
+			newNames++
+		}
+		if lv.UsedInRHS {
+			usedInRHS++
+		}
+	}
+	at := n.Head.From
+	if usedInRHS > 0 {
+		// The var form evaluates the right-hand side before declaring the
+		// variables, so declare them first and assign them with set.
+		c.Rewrite(RuleAssignSelf,
+			"legacy assignment declaring new "+lvalueNames(lvalues, true)+
+				", referred to in the right-hand side; rewritten to var and set").
+			Insert(at, varDecl(lvalues)+"; set ")
+		return
+	}
+	switch newNames {
+	case 0:
+		// No new names: rewrite to set
+		c.Rewrite(RuleAssignSet,
+			"legacy assignment to existing "+lvalueNames(lvalues, false)+
+				"; rewritten to set").Insert(at, "set ")
+	case len(lvalues):
+		// All new names: rewrite to var
+		rw := c.Rewrite(RuleAssignVar,
+			"legacy assignment declaring new "+lvalueNames(lvalues, true)+
+				"; rewritten to var")
+		rw.Insert(at, "var ")
+		for _, lv := range lvalues {
+			if strings.HasPrefix(lv.Source, "local:") {
+				rw.Delete(lv.From, lv.From+len("local:"))
+			}
+		}
+	default:
+		// Mix of existing and new names: rewrite to var + set
+		c.Rewrite(RuleAssignMixed,
+			"legacy assignment declaring new "+lvalueNames(lvalues, true)+
+				" and assigning existing "+lvalueNames(lvalues, false)+
+				"; rewritten to var and set").Insert(at, varDecl(lvalues)+"; set ")
+	}
+}
+
+// 0.16 has a buggy version of "set" that has the semantics of legacy
+// assignment, i.e. it can also create new variable. Pre-declare new variables
+// with "var", if any.
+func (legacyAssignmentPass) Set(c *Context, n *parse.Form, lvalues []LValue) {
+	for _, lv := range lvalues {
+		if lv.NewName != "" {
+			c.Rewrite(RuleBuggySet,
+				"set creating new "+lvalueNames(lvalues, true)+
+					", which is not supported since 0.17; declared with var first").
+				Insert(n.Head.From, varDecl(lvalues)+"; ")
+			return
+		}
+	}
+}
+
+// Returns a var form declaring the new variables in lvalues, like "var a b".
+func varDecl(lvalues []LValue) string {
+	var sb strings.Builder
+	sb.WriteString("var")
+	for _, lv := range lvalues {
+		if lv.NewName != "" {
+			sb.WriteString(" " + lv.NewName)
+		}
+	}
+	return sb.String()
+}
+
+// Returns the variables in lvalues that are new or existing, like "variables $a
+// $b" or "variable $a".
+func lvalueNames(lvs []LValue, isNew bool) string {
+	var names []string
+	for _, lv := range lvs {
+		if isNew && lv.NewName != "" {
+			names = append(names, "$"+lv.NewName)
+		} else if !isNew && lv.NewName == "" {
+			names = append(names, "$"+strings.TrimPrefix(lv.Source, "@"))
+		}
+	}
+	if len(names) == 1 {
+		return "variable " + names[0]
+	}
+	return "variables " + strings.Join(names, " ")
+}
@@ -0,0 +1,123 @@
+package fix
+
+import (
+	"fmt"
+	"strings"
+
+	"src.elv.sh/pkg/parse"
+	"src.elv.sh/pkg/parse/cmpd"
+)
+
+// deprecatedCommandPass replaces calls to deprecated commands with their
+// replacements, importing the module of the replacement if needed, like
+// "has-prefix a b" to "use str; str:has-prefix a b". Calls matching a pattern
+// rule are left to patternPass, and unqualified commands resolving to
+// user-defined functions are left alone.
+type deprecatedCommandPass struct{ NopPass }
+
+func (deprecatedCommandPass) Name() string { return "deprecated-command" }
+
+func (deprecatedCommandPass) Form(c *Context, n *parse.Form) {
+	head, ok := commandName(c, n)
+	if !ok {
+		return
+	}
+	d, ok := c.cp.deprecations[head]
+	if !ok || (!strings.Contains(head, ":") && !isBuiltinCommand(c, head)) {
+		return
+	}
+	if _, ok := matchPatternRule(c, n, head); ok {
+		return
+	}
+	reason := fmt.Sprintf("%s is deprecated since %s; replaced with %s", d.Name, d.Version, d.Replacement)
+	importReason := fmt.Sprintf("deprecated commands replaced with commands of %s, adding \"use %s\"",
+		d.Namespace(), d.module())
+	rw := importingRewrite(c, n, RuleDeprecatedCommand, reason, importReason, d.Namespace(), d.module())
+	rw.Replace(n.Head.From, n.Head.To, d.Replacement)
+}
+
+// A rewrite importing a module at the start of the chunk of a scope, shared by
+// the rewrites of the same rule in the scope that need the module.
+type chunkImport struct {
+	chunk  *parse.Chunk
+	module string
+	rw     rewriter
+}
+
+// Returns the Rewriter for a rewrite of the form that needs the module of the
+// given namespace. If the namespace is empty, special or already in scope, it
+// starts a new rewrite with the given reason. Otherwise the module is imported
+// once at the start of the chunk of the scope containing the form, being the
+// whole code or the body of a lambda, and all the rewrites of the same rule in
+// the scope and the scopes nested in it are made with the rewriter importing
+// it, with importReason, so that each import is applied or skipped together
+// with the calls that need it.
+func importingRewrite(c *Context, n *parse.Form, rule Rule, reason, importReason, ns, module string) *Rewriter {
+	if ns == "" || specialNamespaces[ns] || c.LookupVar(ns) != NoScope {
+		return c.Rewrite(rule, reason)
+	}
+	cp := c.cp
+	var chunk *parse.Chunk
+	for p := parse.Parent(n); p != nil; p = parse.Parent(p) {
+		ch, ok := p.(*parse.Chunk)
+		if !ok || !isScopeChunk(ch) {
+			continue
+		}
+		if chunk == nil {
+			chunk = ch
+		}
+		for _, imp := range cp.imports {
+			if imp.chunk == ch && imp.module == module && imp.rw.rule == rule {
+				return &Rewriter{imp.rw}
+			}
+		}
+	}
+	rw := cp.rewrite(rule, importReason)
+	rw.insertFirst(chunk.Pipelines[0].From, "use "+module+"; ")
+	cp.imports = append(cp.imports, chunkImport{chunk, module, rw})
+	return &Rewriter{rw}
+}
+
+// Returns whether the chunk has a scope of its own, being the whole code or the
+// body of a lambda rather than an output capture.
+func isScopeChunk(n *parse.Chunk) bool {
+	switch p := parse.Parent(n).(type) {
+	case nil:
+		return true
+	case *parse.Primary:
+		return p.Type == parse.Lambda
+	}
+	return false
+}
+
+// Namespaces that are available without importing any module.
+var specialNamespaces = map[string]bool{
+	"local:": true, "up:": true, "e:": true, "E:": true, "builtin:": true}
+
+// Returns the name of the command the form calls, if the head is a string
+// literal and the form is neither a special form nor a legacy assignment.
+func commandName(c *Context, n *parse.Form) (string, bool) {
+	if n.Head == nil {
+		return "", false
+	}
+	head, ok := cmpd.StringLiteral(n.Head)
+	if !ok {
+		return "", false
+	}
+	if _, special := c.cp.special(head); special {
+		return "", false
+	}
+	for _, arg := range n.Args {
+		if parse.SourceText(arg) == "=" {
+			return "", false
+		}
+	}
+	return head, true
+}
+
+// Returns whether the unqualified command resolves to a builtin function rather
+// than a user-defined one.
+func isBuiltinCommand(c *Context, name string) bool {
+	scope := c.LookupVar(name + fnSuffix)
+	return scope == NoScope || scope == BuiltinScope
+}
@@ -0,0 +1,38 @@
+package fix
+
+import (
+	"os"
+
+	"src.elv.sh/pkg/diag"
+	"src.elv.sh/pkg/parse"
+)
+
+// legacyLambdaPass rewrites the legacy lambda syntax to the new syntax.
+type legacyLambdaPass struct{ NopPass }
+
+func (legacyLambdaPass) Name() string { return "legacy-lambda" }
+
+func (legacyLambdaPass) Lambda(c *Context, n *parse.Primary) {
+	if !n.LegacyLambda {
+		return
+	}
+	lbracket, rbracket := -1, -1
+ch:
+	for _, ch := range parse.Children(n) {
+		switch parse.SourceText(ch) {
+		case "[":
+			lbracket = ch.Range().From
+		case "]":
+			rbracket = ch.Range().From
+			break ch
+		}
+	}
+	if lbracket == -1 || rbracket == -1 {
+		diag.Complain(os.Stderr, "code bug: didn't find [ or ] in legacy lambda")
+		return
+	}
+	rw := c.Rewrite(RuleLegacyLambda,
+		"legacy lambda syntax; arguments and options moved into |...|")
+	rw.Replace(lbracket, lbracket+1, "{|")
+	rw.Replace(rbracket, rbracket+2, "|")
+}
@@ -0,0 +1,118 @@
+package fix
+
+import (
+	"strings"
+
+	"src.elv.sh/pkg/diag"
+	"src.elv.sh/pkg/parse"
+)
+
+// patternPass applies the first pattern rule in Opts.PatternRules that matches
+// each form. Only the text around the metavariables is replaced, so that the
+// rewrites inside the arguments they match are kept.
+type patternPass struct{ NopPass }
+
+func (patternPass) Name() string { return "pattern" }
+
+func (patternPass) Form(c *Context, n *parse.Form) {
+	head, ok := commandName(c, n)
+	if !ok {
+		return
+	}
+	m, ok := matchPatternRule(c, n, head)
+	if !ok {
+		return
+	}
+	segments, ok := templateSegments(m, n.Head.From, formEnd(n))
+	if !ok {
+		c.Errorf(n, "can't apply pattern rule %s, since the options and arguments are not in the same order as in the pattern",
+			m.rule.Name)
+	}
+	ns := m.rule.namespace
+	module := strings.TrimSuffix(ns, nsSuffix)
+	code := c.Source().Code
+	rw := importingRewrite(c, n, RulePattern,
+		"pattern rule "+m.rule.Name+": "+m.rule.Pattern+" -> "+m.rule.Replacement,
+		"pattern rules replacing calls with commands of "+ns+", adding \"use "+module+"\"",
+		ns, module)
+	for _, seg := range segments {
+		switch {
+		case seg.From == seg.To:
+			if seg.text != "" {
+				rw.Insert(seg.From, seg.text)
+			}
+		case code[seg.From:seg.To] != seg.text:
+			rw.Replace(seg.From, seg.To, seg.text)
+		}
+	}
+}
+
+// Returns the first pattern rule that applies to the form calling the given
+// command, and the ranges its metavariables match. Rules with the builtin
+// condition are skipped when the command resolves to a user-defined function.
+func matchPatternRule(c *Context, n *parse.Form, head string) (patternMatch, bool) {
+	for _, r := range c.cp.patternRules[head] {
+		if r.Builtin && !isBuiltinCommand(c, head) {
+			continue
+		}
+		if bindings, ok := r.match(n); ok {
+			return patternMatch{r, bindings}, true
+		}
+	}
+	return patternMatch{}, false
+}
+
+// A range of the form to be replaced by literal text of the replacement.
+type segment struct {
+	diag.Ranging
+	text string
+}
+
+// Returns the ranges of the form in the given range outside the text matched
+// by metavariables, with the literal text of the replacement they should be
+// replaced by. It returns false if the metavariables are not in the same order
+// in the form as in the replacement.
+func templateSegments(m patternMatch, from, to int) ([]segment, bool) {
+	var bindings []diag.Ranging
+	var texts []string
+	text := ""
+	for _, part := range m.rule.template {
+		if part.metavar == "" {
+			text += part.text
+			continue
+		}
+		r := m.bindings[part.metavar]
+		if r.From == r.To {
+			// Matched nothing; drop the space separating it.
+			text = strings.TrimRight(text, " \t")
+		}
+		bindings = append(bindings, r)
+		texts = append(texts, text)
+		text = ""
+	}
+	texts = append(texts, text)
+	for i := 1; i < len(bindings); i++ {
+		if bindings[i-1].To > bindings[i].From {
+			return nil, false
+		}
+	}
+	var segments []segment
+	for i, text := range texts {
+		seg := segment{diag.Ranging{From: from, To: to}, text}
+		if i > 0 {
+			seg.From = bindings[i-1].To
+		}
+		if i < len(bindings) {
+			seg.To = bindings[i].From
+		}
+		if len(segments) > 0 && segments[len(segments)-1].To == seg.From {
+			// Separated by a metavariable that matched nothing.
+			last := &segments[len(segments)-1]
+			last.To = seg.To
+			last.text += seg.text
+			continue
+		}
+		segments = append(segments, seg)
+	}
+	return segments, true
+}
@@ -0,0 +1,93 @@
+package fix
+
+import (
+	"strings"
+
+	"src.elv.sh/pkg/parse"
+)
+
+// sourcePass rewrites calls to the -source command, which is removed in 0.17,
+// to eval, like "eval (slurp < file.elv)".
+//
+// The -source command of 0.16 evaluates a file in the current namespace, so
+// the names defined by the file become available to the caller. The file is
+// analyzed to find these names, which are declared in the current scope, and
+// copied back from the namespace of eval by the rewrite, so that they are
+// still available to the caller. If the file is not given as a literal or
+// can't be analyzed, the form is left unmodified with an error.
+type sourcePass struct{ NopPass }
+
+func (sourcePass) Name() string { return "source" }
+
+func (sourcePass) Form(c *Context, n *parse.Form) {
+	head, ok := commandName(c, n)
+	if !ok || head != "-source" || c.LookupVar("-source"+fnSuffix) != NoScope {
+		// Not a call to -source, or shadowed by a user-defined function.
+		return
+	}
+	if len(n.Args) != 1 || len(n.Opts) != 0 {
+		return
+	}
+	arg := n.Args[0]
+	disabled := c.Opts().DisabledRules[RuleSource]
+	path, ok := sourcedPath(arg)
+	if !ok {
+		if disabled {
+			return
+		}
+		c.Errorf(arg, "-source of a computed path; rewrite it to eval by hand, declaring the names the file defines")
+	}
+	defined, err := c.cp.sourcedNames(path)
+	if err != nil {
+		if disabled {
+			return
+		}
+		c.Errorf(arg, "-source of a file that can't be analyzed (%v); rewrite it to eval by hand, declaring the names the file defines", err)
+	}
+	if len(defined) > 0 && !singleForm(n) {
+		c.Errorf(arg, "-source defining %s in a pipeline; source the file separately",
+			strings.Join(dollarNames(defined), " "))
+	}
+	reason := "-source is removed in 0.17; rewritten to eval"
+	if len(defined) > 0 {
+		reason += ", copying back " + strings.Join(dollarNames(defined), " ")
+	}
+	rw := c.Rewrite(RuleSource, reason)
+	head = "eval"
+	if len(defined) > 0 {
+		var newNames []string
+		for _, name := range defined {
+			if c.LookupVar(name) == NoScope {
+				newNames = append(newNames, name)
+			}
+		}
+		var values []string
+		for _, name := range defined {
+			values = append(values, "$ns["+name+"]")
+		}
+		head += " &on-end={|ns| set " + strings.Join(defined, " ") + " = " +
+			strings.Join(values, " ") + " }"
+		if len(newNames) > 0 {
+			head = "var " + strings.Join(newNames, " ") + "; " + head
+		}
+	}
+	if len(defined) > 0 {
+		rw.ReplaceLambda(n.Head.From, n.Head.To, head)
+	} else {
+		rw.Replace(n.Head.From, n.Head.To, head)
+	}
+	rw.Insert(arg.From, "(slurp < ")
+	rw.Insert(arg.To, ")")
+	for _, name := range defined {
+		c.Declare(name)
+	}
+}
+
+// Returns the names with a $ prefix, like "$a" and "$f~".
+func dollarNames(names []string) []string {
+	var result []string
+	for _, name := range names {
+		result = append(result, "$"+name)
+	}
+	return result
+}
@@ -0,0 +1,162 @@
+package fix
+
+import (
+	"strings"
+
+	"src.elv.sh/pkg/parse"
+	"src.elv.sh/pkg/parse/cmpd"
+)
+
+// tempAssignmentPass rewrites temporary assignments, like "a=b cmd", to the
+// tmp command, wrapping the form in a lambda to keep the temporary scope, like
+// "{ tmp a = b; cmd }". It does nothing if the target version of Elvish has no
+// tmp command.
+type tempAssignmentPass struct{ NopPass }
+
+func (tempAssignmentPass) Name() string { return "temporary-assignment" }
+
+func (tempAssignmentPass) Form(c *Context, n *parse.Form) {
+	if len(n.Assignments) == 0 || n.Head == nil || !c.HasSpecial("tmp") {
+		return
+	}
+	lvalues := tempLValues(c, n)
+	// The variables assigned by tmp are restored when the enclosing lambda
+	// returns, so the form needs to be wrapped in a lambda of its own unless
+	// it's already the last thing its lambda does.
+	wrap := !endsLambda(n)
+	if wrap && declares(n) {
+		// The names declared by the form would only be visible in the lambda.
+		c.Errorf(n, "temporary assignment for a form declaring variables; move the declaration out of the form")
+	}
+	prefix := ""
+	for _, lv := range lvalues {
+		if lv.NewName != "" {
+			if !singleForm(n) {
+				c.Errorf(lv, "temporary assignment to new variable $%s in a pipeline; declare the variable first", lv.NewName)
+			}
+			prefix = varDecl(lvalues) + "; "
+			break
+		}
+	}
+	if wrap {
+		prefix += "{ "
+	}
+	rw := c.Rewrite(RuleTempAssign,
+		"temporary assignment to "+lvalueSources(lvalues)+"; rewritten to tmp")
+	if wrap {
+		rw.InsertLambda(n.From, prefix)
+	} else {
+		rw.Insert(n.From, prefix)
+	}
+	for _, a := range n.Assignments {
+		rw.Insert(a.From, "tmp ")
+		rw.Replace(a.Left.To, a.Right.From, " = ")
+		rw.Insert(a.To, ";")
+	}
+	if wrap {
+		rw.Insert(formEnd(n), " }")
+	}
+}
+
+// Returns the variables assigned by the temporary assignments of the form. The
+// variables that don't exist yet are declared by the assignments.
+func tempLValues(c *Context, n *parse.Form) []LValue {
+	var lvalues []LValue
+	declared := make(map[string]bool)
+	var add func(in *parse.Indexing)
+	add = func(in *parse.Indexing) {
+		if in.Head.Type == parse.Braced {
+			for _, cn := range in.Head.Braced {
+				for _, in := range cn.Indexings {
+					add(in)
+				}
+			}
+			return
+		}
+		lv := LValue{Ranging: in.Range(), Source: parse.SourceText(in)}
+		_, qname := splitSigil(in.Head.Value)
+		if c.LookupVar(qname) == NoScope {
+			name := strings.TrimPrefix(strings.TrimPrefix(qname, "local:"), ":")
+			if !declared[name] {
+				lv.NewName = name
+				declared[name] = true
+			}
+		}
+		lvalues = append(lvalues, lv)
+	}
+	for _, a := range n.Assignments {
+		add(a.Left)
+	}
+	return lvalues
+}
+
+// Returns whether the form declares variables in the current scope, being a var,
+// fn or use form or a legacy assignment.
+func declares(n *parse.Form) bool {
+	switch head, _ := cmpd.StringLiteral(n.Head); head {
+	case "var", "fn", "use":
+		return true
+	}
+	for _, arg := range n.Args {
+		if parse.SourceText(arg) == "=" {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the form is the only form in its pipeline, and the pipeline
+// is not run in the background.
+func singleForm(n *parse.Form) bool {
+	pipeline, ok := parse.Parent(n).(*parse.Pipeline)
+	return ok && len(pipeline.Forms) == 1 && !pipeline.Background
+}
+
+// Returns whether the form is the last thing the enclosing lambda does.
+func endsLambda(n *parse.Form) bool {
+	if !singleForm(n) {
+		return false
+	}
+	pipeline := parse.Parent(n).(*parse.Pipeline)
+	chunk, ok := parse.Parent(pipeline).(*parse.Chunk)
+	if !ok || chunk.Pipelines[len(chunk.Pipelines)-1] != pipeline {
+		return false
+	}
+	lambda, ok := parse.Parent(chunk).(*parse.Primary)
+	return ok && lambda.Type == parse.Lambda
+}
+
+// Returns the end of the form, excluding trailing spaces.
+func formEnd(n *parse.Form) int {
+	end := n.Head.To
+	for _, a := range n.Args {
+		end = maxInt(end, a.To)
+	}
+	for _, o := range n.Opts {
+		end = maxInt(end, o.To)
+	}
+	for _, r := range n.Redirs {
+		end = maxInt(end, r.To)
+	}
+	return end
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Returns the variables in lvalues, like "variable $a" or "variables $a
+// $E:b".
+func lvalueSources(lvs []LValue) string {
+	var names []string
+	for _, lv := range lvs {
+		names = append(names, "$"+strings.TrimPrefix(lv.Source, "@"))
+	}
+	if len(names) == 1 {
+		return "variable " + names[0]
+	}
+	return "variables " + strings.Join(names, " ")
+}
@@ -0,0 +1,388 @@
+package fix
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strings"
+
+	"src.elv.sh/pkg/diag"
+	"src.elv.sh/pkg/parse"
+	"src.elv.sh/pkg/parse/cmpd"
+)
+
+// PatternRule is a rewrite rule given as a pattern and a replacement in Elvish
+// syntax, like "splits $sep $s -> str:split $sep $s".
+//
+// The pattern is a single form with a string literal as its head. Variables in
+// the pattern are metavariables: "$name" matches any argument or option value,
+// and "$@name" as the last argument matches all the remaining arguments. A
+// metavariable used more than once must match the same text each time. Other
+// arguments and options must match literally, and forms with redirections never
+// match.
+//
+// The replacement is Elvish code, in which the metavariables of the pattern are
+// replaced by the text they matched. It must use each metavariable exactly
+// once, in the same order as the pattern. If the head of the replacement is in
+// a namespace that is not in scope, like "str:", the module is imported with
+// "use" too.
+type PatternRule struct {
+	// The name of the rule, used in the reasons of its rewrites.
+	Name string
+	// The minimum Elvish version the rule applies to, like "0.17".
+	Version string
+	// If true, the rule only applies when the head of the form resolves to a
+	// builtin command, or to no variable at all, which is the case for
+	// builtins of older Elvish versions and external commands. Functions
+	// defined by the user don't match.
+	Builtin bool
+	// The pattern and replacement, as given.
+	Pattern, Replacement string
+	// Examples of code before and after applying the rule.
+	Examples []PatternExample
+
+	head     string
+	pattern  *parse.Form
+	template []templatePart
+	// The namespace of the head of the replacement, like "str:", if any.
+	namespace string
+}
+
+// PatternExample is an example of applying a PatternRule.
+type PatternExample struct {
+	Before, After string
+}
+
+// A part of a replacement: either literal text or a metavariable.
+type templatePart struct {
+	text    string
+	metavar string
+}
+
+// A match of a PatternRule against a form.
+type patternMatch struct {
+	rule *PatternRule
+	// The ranges of the code matched by each metavariable, keyed by its name
+	// without the "@" prefix. The range of a "$@name" metavariable matching no
+	// arguments is empty, and placed after the preceding argument.
+	bindings map[string]diag.Ranging
+}
+
+// NewPatternRule parses the pattern and replacement into a PatternRule.
+func NewPatternRule(name, version string, builtin bool, pattern, replacement string) (*PatternRule, error) {
+	if _, ok := parseVersion(version); !ok {
+		return nil, fmt.Errorf("invalid version %q", version)
+	}
+	r := &PatternRule{Name: name, Version: version, Builtin: builtin,
+		Pattern: pattern, Replacement: replacement}
+	tree, err := parse.Parse(parse.Source{Name: "pattern", Code: pattern}, parse.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("can't parse pattern: %v", err)
+	}
+	pipelines := tree.Root.Pipelines
+	if len(pipelines) != 1 || len(pipelines[0].Forms) != 1 {
+		return nil, fmt.Errorf("pattern must be a single form")
+	}
+	form := pipelines[0].Forms[0]
+	if len(form.Assignments) > 0 || len(form.Redirs) > 0 {
+		return nil, fmt.Errorf("pattern can't have temporary assignments or redirections")
+	}
+	head, ok := cmpd.StringLiteral(form.Head)
+	if !ok {
+		return nil, fmt.Errorf("head of pattern must be a string literal")
+	}
+	// Metavariables of the pattern, and their order.
+	metavars := make(map[string]bool)
+	var order []*parse.Compound
+	for i, arg := range form.Args {
+		if name, ok := metavar(arg); ok {
+			if strings.HasPrefix(name, "@") && i != len(form.Args)-1 {
+				return nil, fmt.Errorf("$%s must be the last argument of pattern", name)
+			}
+			if name := strings.TrimPrefix(name, "@"); !metavars[name] {
+				metavars[name] = true
+				order = append(order, arg)
+			}
+		}
+	}
+	for _, opt := range form.Opts {
+		if _, ok := cmpd.StringLiteral(opt.Key); !ok {
+			return nil, fmt.Errorf("option names of pattern must be string literals")
+		}
+		if opt.Value == nil {
+			continue
+		}
+		if name, ok := metavar(opt.Value); ok {
+			if strings.HasPrefix(name, "@") {
+				return nil, fmt.Errorf("$%s can't be an option value of pattern", name)
+			}
+			if !metavars[name] {
+				metavars[name] = true
+				order = append(order, opt.Value)
+			}
+		}
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i].From < order[j].From })
+	r.head, r.pattern = head, form
+	r.template, err = parseTemplate(replacement, metavars)
+	if err != nil {
+		return nil, err
+	}
+	r.namespace = replacementNs(replacement)
+	var used []string
+	for _, part := range r.template {
+		if part.metavar != "" {
+			used = append(used, part.metavar)
+		}
+	}
+	if len(used) != len(order) {
+		return nil, fmt.Errorf("replacement must use each metavariable of pattern exactly once")
+	}
+	for i, name := range used {
+		if want, _ := metavar(order[i]); strings.TrimPrefix(want, "@") != name {
+			return nil, fmt.Errorf("replacement must use the metavariables in the same order as pattern")
+		}
+	}
+	return r, nil
+}
+
+// Returns the name of the metavariable if the compound is one, like "s" for
+// "$s" and "@rest" for "$@rest".
+func metavar(n *parse.Compound) (string, bool) {
+	if len(n.Indexings) != 1 || len(n.Indexings[0].Indices) > 0 ||
+		n.Indexings[0].Head.Type != parse.Variable {
+		return "", false
+	}
+	return n.Indexings[0].Head.Value, true
+}
+
+// Returns the namespace of the head of the first form in the replacement, like
+// "str:" for "str:split $sep $s", or an empty string if it has none.
+func replacementNs(replacement string) string {
+	tree, _ := parse.Parse(parse.Source{Name: "replacement", Code: replacement}, parse.Config{})
+	if len(tree.Root.Pipelines) == 0 || len(tree.Root.Pipelines[0].Forms) == 0 {
+		return ""
+	}
+	head, ok := cmpd.StringLiteral(tree.Root.Pipelines[0].Forms[0].Head)
+	if i := strings.LastIndexByte(head, ':'); ok && i != -1 {
+		return head[:i+1]
+	}
+	return ""
+}
+
+// Splits the replacement into literal text and references to the given
+// metavariables.
+func parseTemplate(replacement string, metavars map[string]bool) ([]templatePart, error) {
+	tree, err := parse.Parse(parse.Source{Name: "replacement", Code: replacement}, parse.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("can't parse replacement: %v", err)
+	}
+	var parts []templatePart
+	last := 0
+	var walk func(n parse.Node)
+	walk = func(n parse.Node) {
+		if p, ok := n.(*parse.Primary); ok && p.Type == parse.Variable {
+			if name := strings.TrimPrefix(p.Value, "@"); metavars[name] {
+				parts = append(parts,
+					templatePart{text: replacement[last:p.From]}, templatePart{metavar: name})
+				last = p.To
+				return
+			}
+		}
+		for _, ch := range parse.Children(n) {
+			walk(ch)
+		}
+	}
+	walk(tree.Root)
+	return append(parts, templatePart{text: replacement[last:]}), nil
+}
+
+// ParsePatternRules parses a file of pattern rules. Each rule starts with a
+// line with its name, minimum Elvish version and optionally the "builtin"
+// condition, followed by a line with the pattern and replacement separated by
+// "->", and any number of example lines, like:
+//
+//	rule splits-to-str-split 0.14 builtin
+//	splits $sep $s -> str:split $sep $s
+//	example splits , a,b -> str:split , a,b
+//
+// Empty lines and lines starting with "#" are ignored. The name is used in
+// error messages.
+func ParsePatternRules(name, text string) ([]*PatternRule, error) {
+	var rules []*PatternRule
+	// The header of the rule being parsed, if its pattern is not found yet.
+	var header []string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		errorf := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", name, lineno, fmt.Sprintf(format, args...))
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "rule":
+			if header != nil {
+				return nil, errorf("rule %s has no pattern", header[1])
+			}
+			if len(fields) != 3 && !(len(fields) == 4 && fields[3] == "builtin") {
+				return nil, errorf("want rule name, version and optionally builtin")
+			}
+			header = fields
+		case "example":
+			if header != nil || len(rules) == 0 {
+				return nil, errorf("example must follow the pattern of a rule")
+			}
+			before, after, ok := splitArrow(strings.TrimSpace(strings.TrimPrefix(line, "example")))
+			if !ok {
+				return nil, errorf("want example before and after separated by ->")
+			}
+			r := rules[len(rules)-1]
+			r.Examples = append(r.Examples, PatternExample{before, after})
+		default:
+			if header == nil {
+				return nil, errorf("pattern must follow a rule line")
+			}
+			pattern, replacement, ok := splitArrow(line)
+			if !ok {
+				return nil, errorf("want pattern and replacement separated by ->")
+			}
+			r, err := NewPatternRule(header[1], header[2], len(header) == 4, pattern, replacement)
+			if err != nil {
+				return nil, errorf("rule %s: %v", header[1], err)
+			}
+			rules = append(rules, r)
+			header = nil
+		}
+	}
+	if header != nil {
+		return nil, fmt.Errorf("%s: rule %s has no pattern", name, header[1])
+	}
+	return rules, nil
+}
+
+func splitArrow(s string) (string, string, bool) {
+	i := strings.Index(s, "->")
+	if i == -1 {
+		return "", "", false
+	}
+	return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+len("->"):]), true
+}
+
+// CheckExamples applies the rule alone to its examples with the given options,
+// and returns an error describing the examples that don't produce the expected
+// code.
+func (r *PatternRule) CheckExamples(opts Opts) error {
+	version := opts.Version
+	if version == "" {
+		version = DefaultVersion
+	}
+	if versionLess(version, r.Version) {
+		return fmt.Errorf("rule %s requires Elvish version %s, newer than %s", r.Name, r.Version, version)
+	}
+	opts.PatternRules = []*PatternRule{r}
+	opts.Passes = []Pass{patternPass{}}
+	opts.DisabledRules = nil
+	var failures []string
+	for i, ex := range r.Examples {
+		got, err := Fix(parse.Source{Name: "example", Code: ex.Before}, opts)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("example %d: %v", i+1, err))
+		} else if got != ex.After {
+			failures = append(failures, fmt.Sprintf("example %d: got %q, want %q", i+1, got, ex.After))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("rule %s: %s", r.Name, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Returns whether the form matches the rule, and the ranges matched by the
+// metavariables if it does.
+func (r *PatternRule) match(n *parse.Form) (map[string]diag.Ranging, bool) {
+	if len(n.Redirs) > 0 || len(n.Opts) != len(r.pattern.Opts) {
+		return nil, false
+	}
+	m := &matcher{make(map[string]diag.Ranging), make(map[string]string)}
+	args, rest := r.pattern.Args, ""
+	if len(args) > 0 {
+		if name, ok := metavar(args[len(args)-1]); ok && strings.HasPrefix(name, "@") {
+			args, rest = args[:len(args)-1], name[1:]
+		}
+	}
+	if len(n.Args) < len(args) || (rest == "" && len(n.Args) > len(args)) {
+		return nil, false
+	}
+	for i, p := range args {
+		if !m.match(p, n.Args[i]) {
+			return nil, false
+		}
+	}
+	if rest != "" {
+		end := n.Head.To
+		if len(args) > 0 {
+			end = n.Args[len(args)-1].To
+		}
+		m.bindings[rest] = diag.Ranging{From: end, To: end}
+		if len(n.Args) > len(args) {
+			m.bindings[rest] = diag.Ranging{From: n.Args[len(args)].From, To: n.Args[len(n.Args)-1].To}
+		}
+	}
+	for _, p := range r.pattern.Opts {
+		key, _ := cmpd.StringLiteral(p.Key)
+		o := findOpt(n.Opts, key)
+		if o == nil || (p.Value == nil) != (o.Value == nil) ||
+			(p.Value != nil && !m.match(p.Value, o.Value)) {
+			return nil, false
+		}
+	}
+	return m.bindings, true
+}
+
+func findOpt(opts []*parse.MapPair, key string) *parse.MapPair {
+	for _, o := range opts {
+		if k, ok := cmpd.StringLiteral(o.Key); ok && k == key {
+			return o
+		}
+	}
+	return nil
+}
+
+type matcher struct {
+	bindings map[string]diag.Ranging
+	texts    map[string]string
+}
+
+// Matches the compound p in a pattern against n.
+func (m *matcher) match(p, n *parse.Compound) bool {
+	if name, ok := metavar(p); ok {
+		text := parse.SourceText(n)
+		if bound, ok := m.texts[name]; ok {
+			return bound == text
+		}
+		m.bindings[name] = n.Range()
+		m.texts[name] = text
+		return true
+	}
+	if parse.SourceText(p) == parse.SourceText(n) {
+		return true
+	}
+	ps, pok := cmpd.StringLiteral(p)
+	ns, nok := cmpd.StringLiteral(n)
+	return pok && nok && ps == ns
+}
+
+// Returns the pattern rules in opts that apply with it, keyed by the
+// heads of their patterns.
+func patternRulesOf(opts Opts) map[string][]*PatternRule {
+	m := make(map[string][]*PatternRule)
+	for _, r := range opts.PatternRules {
+		if opts.appliesTo(r.Version) {
+			m[r.head] = append(m[r.head], r)
+		}
+	}
+	return m
+}
@@ -0,0 +1,105 @@
+package fix
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"src.elv.sh/pkg/parse"
+	"src.elv.sh/pkg/parse/cmpd"
+)
+
+// Returns the path given by a compound that is a string literal, optionally
+// starting with "~/".
+func sourcedPath(n *parse.Compound) (string, bool) {
+	if s, ok := cmpd.StringLiteral(n); ok {
+		return s, true
+	}
+	if len(n.Indexings) < 2 || n.Indexings[0].Head.Type != parse.Tilde ||
+		len(n.Indexings[0].Indices) > 0 {
+		return "", false
+	}
+	var sb strings.Builder
+	sb.WriteString("~")
+	for _, in := range n.Indexings[1:] {
+		switch in.Head.Type {
+		case parse.Bareword, parse.SingleQuoted, parse.DoubleQuoted:
+		default:
+			return "", false
+		}
+		if len(in.Indices) > 0 {
+			return "", false
+		}
+		sb.WriteString(in.Head.Value)
+	}
+	s := sb.String()
+	return s, strings.HasPrefix(s, "~/")
+}
+
+// Returns the names of the variables that the file at the given path defines
+// at its top level, including the namespaces it imports, sorted, or an error if
+// the file can't be read or analyzed. A relative path is resolved against the
+// directory of the code being compiled.
+func (cp *compiler) sourcedNames(path string) ([]string, error) {
+	if !strings.HasPrefix(path, "~/") && !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(cp.srcMeta.Name), path)
+	}
+	if cp.sourcing[path] {
+		// Sourcing itself, directly or indirectly.
+		return nil, nil
+	}
+	readFile := cp.opts.ReadFile
+	if readFile == nil {
+		readFile = readFileExpandingTilde
+	}
+	code, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := parse.Parse(parse.Source{Name: path, Code: string(code)}, parse.Config{})
+	if err != nil {
+		return nil, err
+	}
+	// The file is evaluated in the current namespace, so it can see all the
+	// variables visible here.
+	visible, global := make(staticNs), make(staticNs)
+	for _, scope := range cp.scopes {
+		for name := range scope {
+			visible.add(name)
+			global.add(name)
+		}
+	}
+	// Only sourcePass is needed to find the names defined by files sourced in
+	// turn.
+	sub := &compiler{
+		opts: cp.opts, builtin: cp.builtin, specials: cp.specials, scopes: []staticNs{global},
+		srcMeta: tree.Source, passes: []Pass{sourcePass{}}, sourcing: cp.sourcing,
+		deprecations: cp.deprecations, patternRules: cp.patternRules}
+	cp.sourcing[path] = true
+	defer delete(cp.sourcing, path)
+	sub.recovering(func() { sub.visit(tree.Root) })
+	if len(sub.errors) > 0 {
+		return nil, sub.errors[0]
+	}
+	var names []string
+	for name := range global {
+		if !visible.has(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Reads a file, expanding a leading "~/" to the home directory.
+func readFileExpandingTilde(path string) ([]byte, error) {
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, path[2:])
+	}
+	return os.ReadFile(path)
+}
@@ -7,7 +7,7 @@ import (
 )
 
 type varRef struct {
-	local    bool
+	scope    VarScope
 	subNames []string
 }
 
@@ -29,7 +29,7 @@ func resolveVarRef(s *compiler, qname string, r diag.Ranger) *varRef {
 func resolveVarRefLocal(s *compiler, qname string) *varRef {
 	first, rest := splitQName(qname)
 	if s.searchLocal(first) {
-		return &varRef{local: true, subNames: splitQNameSegs(rest)}
+		return &varRef{scope: LocalScope, subNames: splitQNameSegs(rest)}
 	}
 	return nil
 }
@@ -37,7 +37,7 @@ func resolveVarRefLocal(s *compiler, qname string) *varRef {
 func resolveVarRefCapture(s *compiler, qname string) *varRef {
 	first, rest := splitQName(qname)
 	if s.searchCapture(first) {
-		return &varRef{subNames: splitQNameSegs(rest)}
+		return &varRef{scope: CaptureScope, subNames: splitQNameSegs(rest)}
 	}
 	return nil
 }
@@ -53,14 +53,14 @@ func resolveVarRefBuiltin(s *compiler, qname string, r diag.Ranger) *varRef {
 			return resolveVarRefCapture(s, rest)
 		case "e:":
 			if strings.HasSuffix(rest, fnSuffix) {
-				return &varRef{subNames: []string{rest[:len(rest)-1]}}
+				return &varRef{scope: BuiltinScope, subNames: []string{rest[:len(rest)-1]}}
 			}
 		case "E:":
-			return &varRef{subNames: []string{rest}}
+			return &varRef{scope: BuiltinScope, subNames: []string{rest}}
 		}
 	}
 	if s.searchBuiltin(first) {
-		return &varRef{subNames: splitQNameSegs(rest)}
+		return &varRef{scope: BuiltinScope, subNames: splitQNameSegs(rest)}
 	}
 	return nil
 }
@@ -81,3 +81,71 @@ func (cp *compiler) searchCapture(k string) bool {
 func (cp *compiler) searchBuiltin(k string) bool {
 	return cp.builtin.has(k)
 }
+
+// Names newly declared by a legacy assignment form, whose references in the
+// right-hand side are being watched.
+type refWatch struct {
+	// Index of the scope the names are declared in.
+	scope int
+	names map[string]bool
+	// Names referenced in the right-hand side.
+	used map[string]bool
+}
+
+// Starts watching references to the new names in lvalues.
+func (cp *compiler) watchRefs(lvalues []LValue) {
+	w := &refWatch{len(cp.scopes) - 1, make(map[string]bool), make(map[string]bool)}
+	for _, lv := range lvalues {
+		if lv.NewName != "" {
+			w.names[lv.NewName] = true
+		}
+	}
+	cp.refWatches = append(cp.refWatches, w)
+}
+
+// Stops the last watch started, and marks the lvalues referenced since.
+func (cp *compiler) unwatchRefs(lvalues []LValue) {
+	w := cp.refWatches[len(cp.refWatches)-1]
+	cp.refWatches = cp.refWatches[:len(cp.refWatches)-1]
+	for i := range lvalues {
+		if w.used[lvalues[i].NewName] {
+			lvalues[i].UsedInRHS = true
+		}
+	}
+}
+
+// Records a reference to the variable with the given qualified name, like "a",
+// "local:a" or "f~".
+func (cp *compiler) noteRef(qname string) {
+	if len(cp.refWatches) == 0 {
+		return
+	}
+	scope, name := cp.lexicalScopeOf(qname)
+	for _, w := range cp.refWatches {
+		if scope == w.scope && w.names[name] {
+			w.used[name] = true
+		}
+	}
+}
+
+// Returns the index of the lexical scope the variable with the given qualified
+// name is found in, and its name in that scope. The index is -1 if the variable
+// is not found in any lexical scope.
+func (cp *compiler) lexicalScopeOf(qname string) (int, string) {
+	first, rest := splitQName(strings.TrimPrefix(qname, ":"))
+	from, to := len(cp.scopes)-1, 0
+	switch first {
+	case "local:":
+		first, _ = splitQName(rest)
+		to = from
+	case "up:":
+		first, _ = splitQName(rest)
+		from--
+	}
+	for i := from; i >= to; i-- {
+		if cp.scopes[i].has(first) {
+			return i, first
+		}
+	}
+	return -1, first
+}
@@ -1,10 +1,6 @@
 package fix
 
 import (
-	"os"
-	"strings"
-
-	"src.elv.sh/pkg/diag"
 	"src.elv.sh/pkg/parse"
 	"src.elv.sh/pkg/parse/cmpd"
 )
@@ -15,17 +11,39 @@ func (cp *compiler) visit(n parse.Node) {
 		cp.visitForm(n)
 		return
 	case *parse.Primary:
-		if n.Type == parse.Lambda {
-			cp.visitLambda(n)
-			return
-		}
+		cp.visitPrimary(n)
+		return
 	}
+	cp.visitChildren(n)
+}
+
+func (cp *compiler) visitChildren(n parse.Node) {
 	for _, ch := range parse.Children(n) {
 		cp.visit(ch)
 	}
 }
 
+func (cp *compiler) visitPrimary(n *parse.Primary) {
+	cp.eachPass(func(p Pass, c *Context) { p.Primary(c, n) })
+	switch n.Type {
+	case parse.Lambda:
+		cp.visitLambda(n)
+		return
+	case parse.Variable:
+		_, qname := splitSigil(n.Value)
+		cp.noteRef(qname)
+	}
+	cp.visitChildren(n)
+}
+
+// Visits a form. If the form can't be analyzed, the error is recorded and the
+// form is left unmodified.
 func (cp *compiler) visitForm(n *parse.Form) {
+	cp.recovering(func() { cp.visitFormUnchecked(n) })
+}
+
+func (cp *compiler) visitFormUnchecked(n *parse.Form) {
+	cp.eachPass(func(p Pass, c *Context) { p.Form(c, n) })
 	for _, a := range n.Assignments {
 		cp.parseIndexingLValue(a.Left, setLValue|newLValue)
 		cp.visit(a.Right)
@@ -39,12 +57,14 @@ func (cp *compiler) visitForm(n *parse.Form) {
 		return
 	}
 
-	if head, ok := cmpd.StringLiteral(n.Head); ok {
-		if special, ok := builtinSpecials[head]; ok {
+	head, isLiteral := cmpd.StringLiteral(n.Head)
+	if isLiteral {
+		if special, ok := cp.special(head); ok {
 			// A special form
 			special(cp, n)
 			return
 		}
+		cp.noteRef(head + fnSuffix)
 	}
 
 	for i, arg := range n.Args {
@@ -54,40 +74,12 @@ func (cp *compiler) visitForm(n *parse.Form) {
 			lhsNodes[0] = n.Head
 			copy(lhsNodes[1:], n.Args[:i])
 			lvGroup := cp.parseCompoundLValues(lhsNodes, setLValue|newLValue)
-			newNames := 0
-			for _, lv := range lvGroup.lvalues {
-				if lv.newName != "" {
-					newNames++
-				}
-			}
-			at := n.Head.From
-			switch newNames {
-			case 0:
-				// No new names: rewrite to set
-				cp.insert(at, "set ")
-			case len(lvGroup.lvalues):
-				// All new names: rewrite to var
-				cp.insert(at, "var ")
-				for _, lv := range lvGroup.lvalues {
-					if strings.HasPrefix(lv.source, "local:") {
-						cp.delete(lv.From, lv.From+len("local:"))
-					}
-				}
-			default:
-				// Mix of existing and new names: rewrite to var + set
-				var declBuilder strings.Builder
-				declBuilder.WriteString("var")
-				for _, lv := range lvGroup.lvalues {
-					if lv.newName != "" {
-						declBuilder.WriteString(" " + lv.newName)
-					}
-				}
-				cp.insert(at, declBuilder.String()+"; set ")
-			}
-
+			cp.watchRefs(lvGroup.lvalues)
 			for _, a := range n.Args[i+1:] {
 				cp.visit(a)
 			}
+			cp.unwatchRefs(lvGroup.lvalues)
+			cp.eachPass(func(p Pass, c *Context) { p.LegacyAssignment(c, n, lvGroup.lvalues) })
 			return
 		}
 	}
@@ -102,27 +94,7 @@ func (cp *compiler) visitForm(n *parse.Form) {
 }
 
 func (cp *compiler) visitLambda(n *parse.Primary) {
-	if cp.opts.MigrateLambda && n.LegacyLambda {
-		lbracket, rbracket := -1, -1
-	ch:
-		for _, ch := range parse.Children(n) {
-			switch parse.SourceText(ch) {
-			case "[":
-				lbracket = ch.Range().From
-			case "]":
-				rbracket = ch.Range().From
-				break ch
-			}
-		}
-		if lbracket == -1 || rbracket == -1 {
-			diag.Complain(os.Stderr, "code bug: didn't find [ or ] in legacy lambda")
-		} else {
-			cp.delete(lbracket, lbracket+1)
-			cp.insert(lbracket, "{|")
-			cp.delete(rbracket, rbracket+2)
-			cp.insert(rbracket, "|")
-		}
-	}
+	cp.eachPass(func(p Pass, c *Context) { p.Lambda(c, n) })
 
 	// Parse signature.
 	var argNames, optNames []string
@@ -162,12 +134,12 @@ func (cp *compiler) visitLambda(n *parse.Primary) {
 		}
 	}
 
-	local := cp.pushScope()
+	cp.pushScope()
 	for _, argName := range argNames {
-		local.add(argName)
+		cp.declare(argName)
 	}
 	for _, optName := range optNames {
-		local.add(optName)
+		cp.declare(optName)
 	}
 	cp.visit(n.Chunk)
 	cp.popScope()
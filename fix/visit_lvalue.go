@@ -1,25 +1,15 @@
 package fix
 
-import (
-	"src.elv.sh/pkg/diag"
-	"src.elv.sh/pkg/parse"
-)
+import "src.elv.sh/pkg/parse"
 
 // Parsed group of lvalues.
 type lvaluesGroup struct {
-	lvalues []lvalue
+	lvalues []LValue
 	// Index of the rest variable within lvalues. If there is no rest variable,
 	// the index is -1.
 	rest int
 }
 
-// Parsed lvalue.
-type lvalue struct {
-	diag.Ranging
-	source  string
-	newName string
-}
-
 type lvalueFlag uint
 
 const (
@@ -64,6 +54,9 @@ func (cp *compiler) parseIndexingLValue(n *parse.Indexing, f lvalueFlag) lvalues
 	var foundSet bool
 	if f&setLValue != 0 {
 		foundSet = resolveVarRef(cp, qname, n) != nil
+		if foundSet {
+			cp.noteRef(qname)
+		}
 	}
 	var newName string
 	if !foundSet {
@@ -76,11 +69,11 @@ func (cp *compiler) parseIndexingLValue(n *parse.Indexing, f lvalueFlag) lvalues
 		segs := splitQNameSegs(qname)
 		if len(segs) == 1 {
 			// Unqualified name - implicit local
-			cp.thisScope().add(segs[0])
+			cp.declare(segs[0])
 			newName = segs[0]
 		} else if len(segs) == 2 && (segs[0] == "local:" || segs[0] == ":") {
 			// Qualified local name
-			cp.thisScope().add(segs[1])
+			cp.declare(segs[1])
 			newName = segs[1]
 		} else {
 			cp.errorpf(n, "cannot create variable $%s; new variables can only be created in the local scope", qname)
@@ -92,10 +85,10 @@ func (cp *compiler) parseIndexingLValue(n *parse.Indexing, f lvalueFlag) lvalues
 	for i, idx := range n.Indices {
 		ends[i+1] = idx.Range().To
 	}
-	lv := lvalue{n.Range(), parse.SourceText(n), newName}
+	lv := LValue{n.Range(), parse.SourceText(n), newName, false}
 	restIndex := -1
 	if sigil == "@" {
 		restIndex = 0
 	}
-	return lvaluesGroup{[]lvalue{lv}, restIndex}
+	return lvaluesGroup{[]LValue{lv}, restIndex}
 }
@@ -16,6 +16,7 @@ func init() {
 	builtinSpecials = map[string]visitSpecial{
 		"var": visitVar,
 		"set": visitSet,
+		"tmp": visitTmp,
 		"del": visitDel,
 		"fn":  visitFn,
 
@@ -33,6 +34,20 @@ func init() {
 	}
 }
 
+// Special forms that only some versions of Elvish have. When the target version
+// lacks one of them, it is compiled as an ordinary command.
+var versionedSpecials = map[string]bool{"tmp": true}
+
+// Returns the function to visit the special form with the given head, if the
+// head is a special form in the target version.
+func (cp *compiler) special(head string) (visitSpecial, bool) {
+	if versionedSpecials[head] && !cp.specials[head] {
+		return nil, false
+	}
+	special, ok := builtinSpecials[head]
+	return special, ok
+}
+
 func ordinary(cp *compiler, n *parse.Form) {
 	cp.visit(n.Head)
 	for _, a := range n.Args {
@@ -74,23 +89,27 @@ func visitSet(cp *compiler, fn *parse.Form) {
 	if eqIndex == -1 {
 		cp.errorpf(diag.PointRanging(fn.Range().To), "need = and right-hand-side")
 	}
-	// 0.16 has a buggy version of "set" that has the semantics of legacy
-	// assignment, i.e. it can also create new variable. Pre-declare new
-	// variables with "var", if any.
 	lvGroup := cp.parseCompoundLValues(fn.Args[:eqIndex], setLValue|newLValue)
-	hasNew := false
-	var declBuilder strings.Builder
-	declBuilder.WriteString("var")
-	for _, lv := range lvGroup.lvalues {
-		if lv.newName != "" {
-			declBuilder.WriteString(" " + lv.newName)
-			hasNew = true
+	cp.eachPass(func(p Pass, c *Context) { p.Set(c, fn, lvGroup.lvalues) })
+
+	for _, a := range fn.Args[eqIndex+1:] {
+		cp.visit(a)
+	}
+}
+
+// TmpForm = 'tmp' { LHS } '=' { Compound }
+func visitTmp(cp *compiler, fn *parse.Form) {
+	eqIndex := -1
+	for i, cn := range fn.Args {
+		if parse.SourceText(cn) == "=" {
+			eqIndex = i
+			break
 		}
 	}
-	if hasNew {
-		cp.insert(fn.Head.From, declBuilder.String()+"; ")
+	if eqIndex == -1 {
+		cp.errorpf(diag.PointRanging(fn.Range().To), "need = and right-hand-side")
 	}
-
+	cp.parseCompoundLValues(fn.Args[:eqIndex], setLValue)
 	for _, a := range fn.Args[eqIndex+1:] {
 		cp.visit(a)
 	}
@@ -119,7 +138,7 @@ func visitDel(cp *compiler, fn *parse.Form) {
 			continue
 		}
 		if len(indices) == 0 {
-			if ref.local && len(ref.subNames) == 0 {
+			if ref.scope == LocalScope && len(ref.subNames) == 0 {
 				cp.thisScope().del(qname)
 			}
 		}
@@ -138,8 +157,8 @@ func visitFn(cp *compiler, fn *parse.Form) {
 
 	// Define the variable before compiling the body, so that the body may refer
 	// to the function itself.
-	cp.thisScope().add(name + fnSuffix)
-	cp.visitLambda(bodyNode)
+	cp.declare(name + fnSuffix)
+	cp.visitPrimary(bodyNode)
 }
 
 // UseForm = 'use' StringPrimary
@@ -162,7 +181,7 @@ func visitUse(cp *compiler, fn *parse.Form) {
 			"superfluous argument(s)")
 	}
 
-	cp.thisScope().add(name + nsSuffix)
+	cp.declare(name + nsSuffix)
 }
 
 func visitFor(cp *compiler, fn *parse.Form) {
@@ -215,7 +234,7 @@ func visitTry(cp *compiler, fn *parse.Form) {
 	}
 }
 
-func (cp *compiler) compileOneLValue(n *parse.Compound, f lvalueFlag) lvalue {
+func (cp *compiler) compileOneLValue(n *parse.Compound, f lvalueFlag) LValue {
 	if len(n.Indexings) != 1 {
 		cp.errorpf(n, "must be valid lvalue")
 	}
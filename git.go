@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Runs git with the given arguments, and returns its stdout.
+func runGit(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("git %s: %s", args[0], msg)
+	}
+	return out, nil
+}
+
+// Returns the files changed relative to the given ref, which defaults to HEAD.
+// If staged is true, the staged content of files in the index is compared with
+// the ref; otherwise the content in the working tree is. Deleted files are
+// omitted. Paths are relative to the current directory, and only files within
+// the current directory are returned. If pathspecs is non-empty, it further
+// limits the files to consider.
+func gitChangedFiles(ref string, staged bool, pathspecs []string) ([]string, error) {
+	args := []string{"diff", "--name-only", "-z", "--relative", "--no-renames", "--diff-filter=d"}
+	if staged {
+		args = append(args, "--cached")
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+	args = append(args, ref, "--")
+	args = append(args, pathspecs...)
+	out, err := runGit(args...)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name != "" {
+			files = append(files, filepath.FromSlash(name))
+		}
+	}
+	return files, nil
+}
+
+// Returns the content of a file staged in the index. The path is relative to
+// the current directory.
+func gitStagedContent(name string) ([]byte, error) {
+	return runGit("cat-file", "blob", ":./"+filepath.ToSlash(name))
+}
+
+// Returns a diff in the format of git diff that can be applied with git apply
+// from the current directory. It returns an empty string if before and after
+// are the same, and an error if the file is not within the current directory,
+// since git apply can't apply a diff of such a file.
+func gitDiff(name, before, after string) (string, error) {
+	if before == after {
+		return "", nil
+	}
+	rel := filepath.Clean(name)
+	if filepath.IsAbs(rel) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		rel, err = filepath.Rel(wd, rel)
+		if err != nil {
+			return "", err
+		}
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: -patch only supports files within the current directory", name)
+	}
+	rel = filepath.ToSlash(rel)
+	return fmt.Sprintf("diff --git a/%s b/%s\n", rel, rel) +
+		unifiedDiff("a/"+rel, "b/"+rel, before, after), nil
+}
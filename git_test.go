@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Creates a git repository in a temporary directory, and changes into it for
+// the duration of the test.
+func setupGitRepo(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	mustGit(t, "init", "-q")
+	return dir
+}
+
+func mustGit(t *testing.T, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", append(
+		[]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "commit.gpgsign=false"},
+		args...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+}
+
+func mustWriteFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGitChangedFiles_Ref(t *testing.T) {
+	setupGitRepo(t)
+	mustWriteFile(t, "a.elv", "a = 1\n")
+	mustWriteFile(t, "b.elv", "b = 1\n")
+	mustWriteFile(t, "gone.elv", "c = 1\n")
+	mustGit(t, "add", ".")
+	mustGit(t, "commit", "-q", "-m", "base")
+	mustGit(t, "tag", "base")
+	mustWriteFile(t, "a.elv", "a = 2\n")
+	mustGit(t, "rm", "-q", "gone.elv")
+	mustGit(t, "commit", "-q", "-am", "change a")
+	mustWriteFile(t, "b.elv", "b = 2\n")
+	mustWriteFile(t, "untracked.elv", "d = 1\n")
+
+	files, err := gitChangedFiles("base", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.elv", "b.elv"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("got files %q changed since base, want %q", files, want)
+	}
+	files, err = gitChangedFiles("", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b.elv"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("got files %q changed since HEAD, want %q", files, want)
+	}
+	if _, err := gitChangedFiles("nonexistent", false, nil); err == nil {
+		t.Errorf("got nil error for nonexistent ref, want error")
+	}
+}
+
+func TestGitChangedFiles_Staged(t *testing.T) {
+	setupGitRepo(t)
+	mustWriteFile(t, "a.elv", "a = 1\n")
+	mustWriteFile(t, "b.elv", "b = 1\n")
+	mustGit(t, "add", ".")
+	mustGit(t, "commit", "-q", "-m", "base")
+	mustWriteFile(t, "a.elv", "a = staged\n")
+	mustGit(t, "add", "a.elv")
+	mustWriteFile(t, "a.elv", "a = working\n")
+	mustWriteFile(t, "b.elv", "b = working\n")
+
+	files, err := gitChangedFiles("", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.elv"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("got staged files %q, want %q", files, want)
+	}
+	content, err := gitStagedContent("a.elv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a = staged\n"; string(content) != want {
+		t.Errorf("got staged content %q, want %q", content, want)
+	}
+}
+
+func TestGitDiff_Applies(t *testing.T) {
+	dir := setupGitRepo(t)
+	mustWriteFile(t, "a.elv", "a = 1\necho $a\n")
+	mustWriteFile(t, "sub/b.elv", "b = 1\n")
+	mustGit(t, "add", ".")
+	mustGit(t, "commit", "-q", "-m", "base")
+
+	var patch string
+	for _, tc := range []struct{ name, before, after string }{
+		{"a.elv", "a = 1\necho $a\n", "var a = 1\necho $a\n"},
+		{filepath.Join(dir, "sub", "b.elv"), "b = 1\n", "var b = 1\n"},
+	} {
+		diff, err := gitDiff(tc.name, tc.before, tc.after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch += diff
+	}
+	mustWriteFile(t, "upgrade.patch", patch)
+	mustGit(t, "apply", "--check", "upgrade.patch")
+	mustGit(t, "apply", "--cached", "--check", "upgrade.patch")
+
+	if _, err := gitDiff(filepath.Join("..", "outside.elv"), "a = 1\n", "var a = 1\n"); err == nil {
+		t.Errorf("got nil error for file outside the current directory, want error")
+	}
+	if diff, err := gitDiff("a.elv", "same\n", "same\n"); diff != "" || err != nil {
+		t.Errorf("got %q, %v for unchanged file, want empty diff and nil error", diff, err)
+	}
+}
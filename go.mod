@@ -3,3 +3,8 @@ module github.com/elves/upgrade-scripts-for-0.17
 go 1.17
 
 require src.elv.sh v0.16.0-rc1.0.20211013225714-6a92571a2305
+
+require (
+	github.com/mattn/go-isatty v0.0.13 // indirect
+	golang.org/x/sys v0.0.0-20210820121016-41cdb8703e55 // indirect
+)
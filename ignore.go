@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Name of files listing paths to exclude, using the syntax of .gitignore.
+const ignoreFileName = ".elvish-upgrade-ignore"
+
+// A rule from an ignore file.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	// Where the rule comes from, like "a/.gitignore:3".
+	source  string
+	pattern string
+}
+
+// Reads rules from an ignore file. A nonexistent file has no rules.
+func readIgnoreFile(name string) ([]ignoreRule, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		rule, ok := parseIgnoreRule(scanner.Text())
+		if ok {
+			rule.source = fmt.Sprintf("%s:%d", name, lineNo)
+			rules = append(rules, rule)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// Parses a line of an ignore file, returning false if it doesn't contain a
+// rule.
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	// Strip trailing spaces, unless escaped.
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || line[0] == '#' {
+		return ignoreRule{}, false
+	}
+	rule := ignoreRule{pattern: line}
+	if line[0] == '!' {
+		rule.negate = true
+		line = line[1:]
+	} else if line[0] == '\\' && len(line) > 1 && (line[1] == '!' || line[1] == '#') {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	// A pattern with a slash at the beginning or in the middle is relative to
+	// the directory of the ignore file. Otherwise it can match at any level.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	var sb strings.Builder
+	sb.WriteString("^")
+	if !anchored {
+		sb.WriteString("(?:.*/)?")
+	}
+	sb.WriteString(globToRegexp(line))
+	sb.WriteString("$")
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		// Invalid patterns, like ones with unclosed brackets, never match.
+		return ignoreRule{}, false
+	}
+	rule.re = re
+	return rule, true
+}
+
+// Converts a glob pattern of .gitignore to a regular expression.
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			// Zero or more directories.
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case glob[i:] == "**" && i > 0 && glob[i-1] == '/':
+			// Everything inside.
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				sb.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += 1 + end
+		case c == '\\' && i+1 < len(glob):
+			i++
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return sb.String()
+}
+
+// Decides whether paths are excluded by ignore files. Ignore files apply to the
+// directory containing them and all its subdirectories, with rules in deeper
+// files taking precedence. The ignore files considered are those in the
+// directory of a path and its ancestors, up to the root of the Git repository
+// containing the path, or the working directory if the path is not in a Git
+// repository.
+type ignorer struct {
+	// Names of ignore files to read.
+	names []string
+	// Rules from the ignore files in each directory, keyed by absolute path.
+	rules map[string][]ignoreRule
+	// Cached results for directories, keyed by absolute path.
+	dirs map[string]string
+	// Cached results of ignoreTop, keyed by the absolute path of the parent
+	// directory.
+	tops map[string]string
+}
+
+func newIgnorer(names ...string) *ignorer {
+	return &ignorer{names, make(map[string][]ignoreRule),
+		make(map[string]string), make(map[string]string)}
+}
+
+// Returns the source and pattern of the rule that excludes the path, or an
+// empty string if the path is not excluded.
+func (ig *ignorer) match(path string, isDir bool) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	parent := filepath.Dir(abs)
+	top, ok := ig.tops[parent]
+	if !ok {
+		top = ignoreTop(abs)
+		ig.tops[parent] = top
+	}
+	return ig.matchUnder(abs, isDir, top)
+}
+
+// Like match, but takes an absolute path and the topmost directory whose
+// ignore files apply.
+func (ig *ignorer) matchUnder(abs string, isDir bool, top string) (string, error) {
+	if isDir {
+		if reason, ok := ig.dirs[abs]; ok {
+			return reason, nil
+		}
+	}
+	parent := filepath.Dir(abs)
+	if parent != top {
+		// If the parent directory is excluded, so is everything inside.
+		reason, err := ig.matchUnder(parent, true, top)
+		if err != nil || reason != "" {
+			return reason, err
+		}
+	}
+	// Find the last matching rule, going from the top to the parent.
+	var dirs []string
+	for dir := parent; ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == top {
+			break
+		}
+	}
+	var matched *ignoreRule
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rules, err := ig.rulesIn(dirs[i])
+		if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(dirs[i], abs)
+		if err != nil {
+			return "", err
+		}
+		rel = filepath.ToSlash(rel)
+		for j := range rules {
+			rule := &rules[j]
+			if (!rule.dirOnly || isDir) && rule.re.MatchString(rel) {
+				matched = rule
+			}
+		}
+	}
+	reason := ""
+	if matched != nil && !matched.negate {
+		reason = matched.source + ": " + matched.pattern
+	}
+	if isDir {
+		ig.dirs[abs] = reason
+	}
+	return reason, nil
+}
+
+func (ig *ignorer) rulesIn(dir string) ([]ignoreRule, error) {
+	if rules, ok := ig.rules[dir]; ok {
+		return rules, nil
+	}
+	var rules []ignoreRule
+	for _, name := range ig.names {
+		more, err := readIgnoreFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, more...)
+	}
+	ig.rules[dir] = rules
+	return rules, nil
+}
+
+// Returns the topmost directory whose ignore files apply to the given absolute
+// path. This is the root of the Git repository containing the path if there is
+// one, or the working directory if the path is inside it, or otherwise the
+// directory containing the path.
+func ignoreTop(abs string) string {
+	for dir := filepath.Dir(abs); ; {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	if wd, err := os.Getwd(); err == nil &&
+		strings.HasPrefix(abs, wd+string(filepath.Separator)) {
+		return wd
+	}
+	return filepath.Dir(abs)
+}
@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+var ignoreRuleTests = []struct {
+	pattern string
+	path    string
+	isDir   bool
+	match   bool
+}{
+	{"foo.elv", "foo.elv", false, true},
+	{"foo.elv", "a/b/foo.elv", false, true},
+	{"foo.elv", "a/foo.elv.bak", false, false},
+	{"*.elv", "a/b.elv", false, true},
+	{"/*.elv", "a/b.elv", false, false},
+	{"/*.elv", "b.elv", false, true},
+	{"a/*.elv", "a/b.elv", false, true},
+	{"a/*.elv", "x/a/b.elv", false, false},
+	{"vendor/", "vendor", true, true},
+	{"vendor/", "vendor", false, false},
+	{"**/gen", "a/b/gen", true, true},
+	{"**/gen", "gen", true, true},
+	{"a/**/b.elv", "a/b.elv", false, true},
+	{"a/**/b.elv", "a/x/y/b.elv", false, true},
+	{"a/**", "a/x/y.elv", false, true},
+	{"a/**", "a", true, false},
+	{"?.elv", "x.elv", false, true},
+	{"?.elv", "xy.elv", false, false},
+	{"[a-c].elv", "b.elv", false, true},
+	{"[!a-c].elv", "b.elv", false, false},
+	{`\!x.elv`, "!x.elv", false, true},
+	{`\#x.elv`, "#x.elv", false, true},
+}
+
+func TestIgnoreRule(t *testing.T) {
+	for _, tc := range ignoreRuleTests {
+		rule, ok := parseIgnoreRule(tc.pattern)
+		if !ok {
+			t.Errorf("parseIgnoreRule(%q) returns false", tc.pattern)
+			continue
+		}
+		match := (!rule.dirOnly || tc.isDir) && rule.re.MatchString(tc.path)
+		if match != tc.match {
+			t.Errorf("pattern %q matching %q (dir = %v): got %v, want %v",
+				tc.pattern, tc.path, tc.isDir, match, tc.match)
+		}
+	}
+}
+
+func TestIgnoreRule_NoRule(t *testing.T) {
+	for _, line := range []string{"", "   ", "# comment", "/"} {
+		if _, ok := parseIgnoreRule(line); ok {
+			t.Errorf("parseIgnoreRule(%q) returns true", line)
+		}
+	}
+}
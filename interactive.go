@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/elves/upgrade-scripts-for-0.17/fix"
+	"src.elv.sh/pkg/parse"
+)
+
+const interactiveHelp = `y - apply this rewrite
+n - skip this rewrite
+a - apply this rewrite and all remaining rewrites of the same rule
+q - quit; skip this rewrite and all remaining ones
+? - print help
+`
+
+// State of an interactive session with -i, shared by all the files.
+type session struct {
+	in  *bufio.Reader
+	out io.Writer
+	// Rules whose rewrites are all accepted.
+	acceptAll map[fix.Rule]bool
+	// Whether the user has quit.
+	quit bool
+}
+
+func newSession(in io.Reader, out io.Writer) *session {
+	return &session{bufio.NewReader(in), out, make(map[fix.Rule]bool), false}
+}
+
+// Reports whether the file is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Like process, but lets the user choose the rewrites to apply, and rewrites
+// the source with them.
+func (s *session) process(o *output, name string, code []byte, write func(fixed string) error) status {
+	if s.quit {
+		return unchanged
+	}
+	src := parse.Source{Name: name, Code: string(code)}
+	edits, err := fix.Edits(src, fixOpts)
+	if err != nil && fix.GetError(err) == nil {
+		o.showError(err)
+		return failed
+	}
+	// With compilation errors, the rewrites for the rest of the code are still
+	// offered, and the errors are shown afterwards.
+	st := s.chooseAndWrite(o, name, src.Code, edits, write)
+	if err != nil {
+		o.showError(err)
+		return failed
+	}
+	return st
+}
+
+func (s *session) chooseAndWrite(o *output, name, code string, edits []fix.Edit, write func(fixed string) error) status {
+	if len(edits) == 0 {
+		return unchanged
+	}
+	fmt.Fprintf(s.out, "--- %s\n+++ %s\n", name, name)
+	chosen := s.choose(code, edits)
+	if len(chosen) == 0 {
+		return unchanged
+	}
+	fixed := fix.Apply(code, chosen)
+	if *verify && !verifyFixed(o, name, code, fixed) {
+		return failed
+	}
+	// The invariants only hold for the full fix; fixing a partially rewritten
+	// file again would redo the skipped rewrites.
+	if *selfCheck && len(chosen) == len(edits) && !runSelfCheck(o, name, code, fixed) {
+		return failed
+	}
+	if err := write(fixed); err != nil {
+		o.showError(err)
+		return failed
+	}
+	return changed
+}
+
+// Asks the user about each rewrite, and returns the edits of the accepted
+// ones.
+func (s *session) choose(code string, edits []fix.Edit) []fix.Edit {
+	var rewrites [][]fix.Edit
+	for _, edit := range edits {
+		for len(rewrites) <= edit.Rewrite {
+			rewrites = append(rewrites, nil)
+		}
+		rewrites[edit.Rewrite] = append(rewrites[edit.Rewrite], edit)
+	}
+	accepted := make(map[int]bool)
+	for i, rw := range rewrites {
+		if s.quit {
+			break
+		}
+		if s.acceptAll[rw[0].Rule] || s.ask(code, rw) {
+			accepted[i] = true
+		}
+	}
+	var acceptedEdits []fix.Edit
+	for _, edit := range edits {
+		if accepted[edit.Rewrite] {
+			acceptedEdits = append(acceptedEdits, edit)
+		}
+	}
+	return acceptedEdits
+}
+
+// Shows a rewrite and asks the user whether to apply it.
+func (s *session) ask(code string, rw []fix.Edit) bool {
+	rule := rw[0].Rule
+	fmt.Fprintln(s.out, rw[0].Reason)
+	fmt.Fprint(s.out, diffHunks(code, fix.Apply(code, rw)))
+	for {
+		fmt.Fprintf(s.out, "Apply this rewrite (%s) [y,n,a,q,?]? ", rule)
+		line, err := s.in.ReadString('\n')
+		if err != nil && line == "" {
+			// Treat EOF like q.
+			fmt.Fprintln(s.out)
+			s.quit = true
+			return false
+		}
+		switch strings.TrimSpace(line) {
+		case "y":
+			return true
+		case "n":
+			return false
+		case "a":
+			s.acceptAll[rule] = true
+			return true
+		case "q":
+			s.quit = true
+			return false
+		default:
+			fmt.Fprint(s.out, interactiveHelp)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/elves/upgrade-scripts-for-0.17/fix"
+	"src.elv.sh/pkg/parse"
+)
+
+// Code with two rewrites of the assign-var rule followed by two rewrites of the
+// legacy-lambda rule.
+const sessionTestCode = "a = 1\nb = 2\nfn f [x]{ }\nfn g [y]{ }\n"
+
+var sessionTests = []struct {
+	name    string
+	answers string
+	// The written code, or "" if nothing is written.
+	want   string
+	status status
+}{
+	{
+		name:    "yes and no",
+		answers: "y\nn\ny\nn\n",
+		want:    "var a = 1\nb = 2\nfn f {|x| }\nfn g [y]{ }\n",
+		status:  changed,
+	},
+	{
+		name:    "all of a rule",
+		answers: "a\nn\ny\n",
+		want:    "var a = 1\nvar b = 2\nfn f [x]{ }\nfn g {|y| }\n",
+		status:  changed,
+	},
+	{
+		name:    "quit",
+		answers: "y\nq\n",
+		want:    "var a = 1\nb = 2\nfn f [x]{ }\nfn g [y]{ }\n",
+		status:  changed,
+	},
+	{
+		name:    "EOF",
+		answers: "n\ny",
+		want:    "a = 1\nvar b = 2\nfn f [x]{ }\nfn g [y]{ }\n",
+		status:  changed,
+	},
+	{
+		name:    "nothing accepted",
+		answers: "n\nn\nn\nn\n",
+		status:  unchanged,
+	},
+	{
+		name:    "help",
+		answers: "?\nn\nn\nn\nn\n",
+		status:  unchanged,
+	},
+}
+
+func TestSession(t *testing.T) {
+	for _, tc := range sessionTests {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			s := newSession(strings.NewReader(tc.answers), &out)
+			written := ""
+			write := func(fixed string) error {
+				written = fixed
+				return nil
+			}
+			st := s.process(&output{}, "a.elv", []byte(sessionTestCode), write)
+			if st != tc.status {
+				t.Errorf("got status %v, want %v", st, tc.status)
+			}
+			if written != tc.want {
+				t.Errorf("got written code %q, want %q", written, tc.want)
+			}
+			if strings.HasPrefix(tc.answers, "?") && !strings.Contains(out.String(), interactiveHelp) {
+				t.Errorf("got output %q, want it to contain the help", out.String())
+			}
+		})
+	}
+}
+
+func TestSession_QuitSkipsLaterFiles(t *testing.T) {
+	s := newSession(strings.NewReader("q\ny\n"), &bytes.Buffer{})
+	write := func(fixed string) error {
+		t.Errorf("got code written: %q", fixed)
+		return nil
+	}
+	for _, name := range []string{"a.elv", "b.elv"} {
+		if st := s.process(&output{}, name, []byte(sessionTestCode), write); st != unchanged {
+			t.Errorf("got status %v for %s, want unchanged", st, name)
+		}
+	}
+}
+
+func TestSession_ChooseKeepsRewritesWhole(t *testing.T) {
+	code := "fn f [x]{ }"
+	edits, err := fix.Edits(parse.Source{Name: "a.elv", Code: code}, fix.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSession(strings.NewReader("y\n"), &bytes.Buffer{})
+	if chosen := s.choose(code, edits); len(chosen) != len(edits) {
+		t.Errorf("got %d edits chosen, want all %d edits of the rewrite", len(chosen), len(edits))
+	}
+}
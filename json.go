@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/elves/upgrade-scripts-for-0.17/fix"
+	"src.elv.sh/pkg/diag"
+	"src.elv.sh/pkg/parse"
+)
+
+// JSON record for one file, output with -json.
+type jsonFile struct {
+	File   string      `json:"file"`
+	Edits  []jsonEdit  `json:"edits"`
+	Errors []jsonError `json:"errors,omitempty"`
+}
+
+type jsonEdit struct {
+	Rule   fix.Rule `json:"rule"`
+	Reason string   `json:"reason"`
+	// Edits with the same rewrite number should be applied together.
+	Rewrite int `json:"rewrite"`
+	jsonRange
+	Deleted  string `json:"deleted"`
+	Inserted string `json:"inserted"`
+}
+
+type jsonError struct {
+	Type    string `json:"type,omitempty"`
+	Message string `json:"message"`
+	*jsonRange
+}
+
+type jsonRange struct {
+	// Byte offsets.
+	From int `json:"from"`
+	To   int `json:"to"`
+	// Line and column numbers.
+	Start position `json:"start"`
+	End   position `json:"end"`
+}
+
+// Position in source code. Both the line and column numbers are 1-based, and
+// columns are counted in codepoints.
+type position struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// Returns the JSON record for the code in the named file, given the edits and
+// error returned by fix.Edits.
+func makeJSONFile(name, code string, edits []fix.Edit, err error) jsonFile {
+	lines := newLineIndex(code)
+	f := jsonFile{File: name, Edits: []jsonEdit{}}
+	for _, edit := range edits {
+		f.Edits = append(f.Edits, jsonEdit{
+			edit.Rule, edit.Reason, edit.Rewrite, lines.makeRange(edit.Ranging), code[edit.From:edit.To], edit.Text})
+	}
+	if err != nil {
+		if entries := diagErrors(err); entries != nil {
+			for _, e := range entries {
+				r := lines.makeRange(e.Range())
+				f.Errors = append(f.Errors, jsonError{e.Type, e.Message, &r})
+			}
+		} else {
+			f.Errors = []jsonError{{Message: err.Error()}}
+		}
+	}
+	return f
+}
+
+func marshalJSONLine(f jsonFile) []byte {
+	// Marshaling can't fail since the types above only contain strings and
+	// ints.
+	data, _ := json.Marshal(f)
+	return append(data, '\n')
+}
+
+// Returns the *diag.Error values contained in err, or nil if there is none.
+func diagErrors(err error) []*diag.Error {
+	if pe := parse.GetError(err); pe != nil {
+		return pe.Entries
+	}
+	if fe := fix.GetError(err); fe != nil {
+		return fe.Entries
+	}
+	var de *diag.Error
+	if errors.As(err, &de) {
+		return []*diag.Error{de}
+	}
+	return nil
+}
+
+// Maps byte offsets to line and column numbers.
+type lineIndex struct {
+	code string
+	// Byte offsets of the start of each line.
+	starts []int
+}
+
+func newLineIndex(code string) lineIndex {
+	starts := []int{0}
+	for i := strings.IndexByte(code, '\n'); i != -1; {
+		starts = append(starts, starts[len(starts)-1]+i+1)
+		i = strings.IndexByte(code[starts[len(starts)-1]:], '\n')
+	}
+	return lineIndex{code, starts}
+}
+
+func (li lineIndex) position(offset int) position {
+	// The index of the first line that starts after offset.
+	i := sort.SearchInts(li.starts, offset+1)
+	start := li.starts[i-1]
+	return position{i, utf8.RuneCountInString(li.code[start:offset]) + 1}
+}
+
+func (li lineIndex) makeRange(r diag.Ranging) jsonRange {
+	return jsonRange{r.From, r.To, li.position(r.From), li.position(r.To)}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/elves/upgrade-scripts-for-0.17/fix"
+	"src.elv.sh/pkg/parse"
+)
+
+var makeJSONFileTests = []struct {
+	name string
+	code string
+	want jsonFile
+}{
+	{
+		name: "unchanged.elv",
+		code: "var a = 1\n",
+		want: jsonFile{File: "unchanged.elv", Edits: []jsonEdit{}},
+	},
+	{
+		name: "edits.elv",
+		code: "echo αβ\na = 1; f = [x]{ }\n",
+		want: jsonFile{File: "edits.elv", Edits: []jsonEdit{
+			{fix.RuleAssignVar, "legacy assignment declaring new variable $a; rewritten to var", 0,
+				jsonRange{10, 10, position{2, 1}, position{2, 1}}, "", "var "},
+			{fix.RuleAssignVar, "legacy assignment declaring new variable $f; rewritten to var", 1,
+				jsonRange{17, 17, position{2, 8}, position{2, 8}}, "", "var "},
+			{fix.RuleLegacyLambda, "legacy lambda syntax; arguments and options moved into |...|", 2,
+				jsonRange{21, 22, position{2, 12}, position{2, 13}}, "[", "{|"},
+			{fix.RuleLegacyLambda, "legacy lambda syntax; arguments and options moved into |...|", 2,
+				jsonRange{23, 25, position{2, 14}, position{2, 16}}, "]{", "|"},
+		}},
+	},
+	{
+		name: "errors.elv",
+		code: "a = 1\nput (del $b)\n",
+		want: jsonFile{File: "errors.elv",
+			Edits: []jsonEdit{
+				{fix.RuleAssignVar, "legacy assignment declaring new variable $a; rewritten to var", 0,
+					jsonRange{0, 0, position{1, 1}, position{1, 1}}, "", "var "},
+			},
+			Errors: []jsonError{
+				{"compilation error", "arguments to del must drop $", &jsonRange{15, 17, position{2, 10}, position{2, 12}}},
+			}},
+	},
+}
+
+func TestMakeJSONFile(t *testing.T) {
+	for _, tc := range makeJSONFileTests {
+		t.Run(tc.name, func(t *testing.T) {
+			edits, err := fix.Edits(parse.Source{Name: tc.name, Code: tc.code}, fix.Opts{})
+			got := makeJSONFile(tc.name, tc.code, edits, err)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMakeJSONFile_OtherError(t *testing.T) {
+	got := makeJSONFile("a.elv", "", nil, errors.New("can't read"))
+	want := jsonFile{File: "a.elv", Edits: []jsonEdit{}, Errors: []jsonError{{Message: "can't read"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+var marshalJSONLineTests = []struct {
+	f    jsonFile
+	want string
+}{
+	{
+		jsonFile{File: "a.elv", Edits: []jsonEdit{}},
+		`{"file":"a.elv","edits":[]}` + "\n",
+	},
+	{
+		jsonFile{File: "a.elv",
+			Edits: []jsonEdit{{fix.RuleAssignVar, "reason", 0,
+				jsonRange{0, 0, position{1, 1}, position{1, 1}}, "", "var "}},
+			Errors: []jsonError{{Message: "can't read"}}},
+		`{"file":"a.elv","edits":[{"rule":"assign-var","reason":"reason","rewrite":0,` +
+			`"from":0,"to":0,"start":{"line":1,"column":1},"end":{"line":1,"column":1},` +
+			`"deleted":"","inserted":"var "}],"errors":[{"message":"can't read"}]}` + "\n",
+	},
+}
+
+func TestMarshalJSONLine(t *testing.T) {
+	for _, tc := range marshalJSONLineTests {
+		if got := string(marshalJSONLine(tc.f)); got != tc.want {
+			t.Errorf("got %s, want %s", got, tc.want)
+		}
+	}
+}
@@ -5,51 +5,529 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"runtime"
+	"strings"
 
 	"github.com/elves/upgrade-scripts-for-0.17/fix"
-	"src.elv.sh/pkg/diag"
 	"src.elv.sh/pkg/parse"
+	"src.elv.sh/pkg/prog"
 )
 
 var (
-	rewrite = flag.Bool("w", false, "rewrite files")
-	lambda  = flag.Bool("lambda", true, "migrate lambda syntax")
+	rewrite     = flag.Bool("w", false, "rewrite files")
+	doDiff      = flag.Bool("d", false, "display diffs instead of rewriting files")
+	list        = flag.Bool("l", false, "list files whose content would be rewritten")
+	check       = flag.Bool("check", false, "don't output anything for files; exit with 1 if any file needs to be rewritten")
+	patch       = flag.Bool("patch", false, "output a patch for all files that can be applied with git apply")
+	jsonOut     = flag.Bool("json", false, "output the edits for each file as a line of JSON")
+	sarif       = flag.Bool("sarif", false, "output a SARIF log with the pending rewrites and errors of all files")
+	backup      = flag.String("backup", "", "when rewriting files, save the original content to the file name plus this suffix, like .orig")
+	interactive = flag.Bool("i", false, "interactively choose the rewrites to apply, and rewrite files with them")
+	gitRef      = flag.String("git-ref", "", "only process files changed relative to this git ref")
+	gitStaged   = flag.Bool("git-staged", false, "only process files staged in the git index, using their staged content")
+	gitignore   = flag.Bool("gitignore", false, "also exclude files ignored by .gitignore files")
+	verbose     = flag.Bool("v", false, "report files and directories skipped because of ignore files or being .git")
+	jobs        = flag.Int("j", runtime.GOMAXPROCS(0), "number of files to process in parallel")
+	enable      = flag.String("enable", "", "comma-separated list of rules to apply; all rules if empty")
+	disable     = flag.String("disable", "", "comma-separated list of rules not to apply")
+	listRules   = flag.Bool("list-rules", false, "list all the rules with their descriptions and exit")
+	verify      = flag.Bool("verify", false, "compile the rewritten code with Elvish, reporting errors and deprecations, and don't write code that doesn't compile")
+	selfCheck   = flag.Bool("self-check", false, "check that fixing is idempotent and keeps the structure of the code, reporting violations as bugs")
+	elvishVer   = flag.String("elvish-version", fix.DefaultVersion, "Elvish version the rewritten scripts are for, whose builtins are assumed; one of "+strings.Join(fix.Versions(), ", "))
+	tolerant    = flag.Bool("tolerant", false, "fix files with parse errors, except for the top-level pipelines with errors")
+	deprecTable = flag.String("deprecations", "", "file with a table of more deprecated commands to rewrite, like renames in your own modules")
+	rulesFile   = flag.String("rules", "", "file with pattern rules to apply")
+	testRules   = flag.Bool("test-rules", false, "check the examples of the pattern rules given with -rules and exit")
+	fromVer     = flag.String("from", "", "Elvish version the scripts are written for, to also replace the commands deprecated by every later release in order; one of "+strings.Join(fix.Releases(), ", "))
+	explain     = flag.Bool("explain", false, "list the rewrites made in each upgrade step instead of outputting the rewritten script")
+)
+
+// Options for fixing, derived from -enable, -disable, -elvish-version,
+// -tolerant, -deprecations and -rules.
+var fixOpts fix.Opts
+
+// Upgrade steps to apply with -from or -explain, or nil.
+var chain []fix.Step
+
+// The interactive session with -i, or nil.
+var sess *session
+
+// Exit statuses.
+const (
+	// Some file needs to be rewritten; only used with -check.
+	exitNeedsRewrite = 1
+	// Some file could not be read or fixed.
+	exitError = 2
+)
+
+// Result of processing a single file.
+type status int
+
+const (
+	unchanged status = iota
+	changed
+	failed
 )
 
 func main() {
 	flag.Parse()
+	if *listRules {
+		for _, rule := range fix.AllRules {
+			fmt.Printf("%s\t%s\n", rule, rule.Description())
+		}
+		return
+	}
+	opts, err := parseRuleFlags(*enable, *disable)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+	fixOpts = opts
+	fixOpts.Tolerant = *tolerant
+	if !contains(fix.Versions(), *elvishVer) {
+		fmt.Fprintf(os.Stderr, "unknown Elvish version %q for -elvish-version; known versions are %s\n",
+			*elvishVer, strings.Join(fix.Versions(), ", "))
+		os.Exit(exitError)
+	}
+	if *elvishVer != fix.DefaultVersion {
+		if *fromVer != "" || *explain {
+			fmt.Fprintln(os.Stderr, "-elvish-version can't be used with -from or -explain, which upgrade to "+fix.DefaultVersion)
+			os.Exit(exitError)
+		}
+		if *verify {
+			fmt.Fprintln(os.Stderr, "-verify can only be used with the Elvish version this program is built with, "+fix.DefaultVersion)
+			os.Exit(exitError)
+		}
+	}
+	fixOpts.Version = *elvishVer
+	if *deprecTable != "" {
+		table, err := os.ReadFile(*deprecTable)
+		if err == nil {
+			fixOpts.Deprecations, err = fix.ParseDeprecations(*deprecTable, string(table))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitError)
+		}
+	}
+	if *rulesFile != "" {
+		text, err := os.ReadFile(*rulesFile)
+		if err == nil {
+			fixOpts.PatternRules, err = fix.ParsePatternRules(*rulesFile, string(text))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitError)
+		}
+	}
+	if *testRules {
+		if *rulesFile == "" {
+			fmt.Fprintln(os.Stderr, "-test-rules requires -rules")
+			os.Exit(exitError)
+		}
+		os.Exit(checkRuleExamples(fixOpts))
+	}
+	if *fromVer != "" || *explain {
+		from := *fromVer
+		if from == "" {
+			// Only the last step.
+			releases := fix.Releases()
+			from = releases[len(releases)-1]
+		}
+		chain, err = fix.Chain(from)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "-from:", err)
+			os.Exit(exitError)
+		}
+	}
+	if *verify {
+		prog.DeprecationLevel = verifyDeprecationLevel
+	}
+	if *jobs < 1 {
+		fmt.Fprintln(os.Stderr, "-j must be at least 1")
+		os.Exit(exitError)
+	}
+	if countTrue(*list, *doDiff, *patch, *jsonOut, *sarif, *explain) > 1 {
+		fmt.Fprintln(os.Stderr, "only one of -l, -d, -patch, -json, -sarif and -explain can be used")
+		os.Exit(exitError)
+	}
+	if chain != nil && (*jsonOut || *sarif || *interactive) {
+		fmt.Fprintln(os.Stderr, "-from and -explain can't be used with -json, -sarif or -i")
+		os.Exit(exitError)
+	}
+	if *gitStaged && (*rewrite || *interactive) {
+		fmt.Fprintln(os.Stderr, "-git-staged can't be used with -w or -i; use -patch and git apply --cached instead")
+		os.Exit(exitError)
+	}
+	if *backup != "" && !*rewrite && !*interactive {
+		fmt.Fprintln(os.Stderr, "-backup can only be used with -w or -i")
+		os.Exit(exitError)
+	}
 	args := flag.Args()
-	if len(args) == 0 {
-		process("[stdin]", os.Stdin, os.Stdout)
-	} else {
-		for _, arg := range args {
-			f, err := os.OpenFile(arg, os.O_RDWR, 0)
-			if err != nil {
-				diag.ShowError(os.Stderr, err)
-				continue
-			}
-			w := os.Stdout
-			if *rewrite {
-				w = f
+	gitMode := *gitRef != "" || *gitStaged
+	if *interactive {
+		if countTrue(*list, *doDiff, *patch, *jsonOut, *sarif, *check) > 0 {
+			fmt.Fprintln(os.Stderr, "-i can't be used with -l, -d, -patch, -json, -sarif or -check")
+			os.Exit(exitError)
+		}
+		if len(args) == 0 && !gitMode {
+			fmt.Fprintln(os.Stderr, "-i requires files or directories as arguments")
+			os.Exit(exitError)
+		}
+		if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+			fmt.Fprintln(os.Stderr, "-i requires stdin and stdout to be terminals")
+			os.Exit(exitError)
+		}
+		sess = newSession(os.Stdin, os.Stdout)
+		// The user is asked about files one by one.
+		*jobs = 1
+	}
+	ignoreFiles := []string{ignoreFileName}
+	if *gitignore {
+		ignoreFiles = append(ignoreFiles, ".gitignore")
+	}
+	ig := newIgnorer(ignoreFiles...)
+	var tasks []task
+	switch {
+	case gitMode:
+		tasks = findGitTasks(args, ig)
+	case len(args) == 0:
+		tasks = []task{processStdin}
+	default:
+		tasks = findTasks(args, ig)
+	}
+	var collect func(*output)
+	var sarifResults []sarifResult
+	if *sarif {
+		collect = func(o *output) { sarifResults = append(sarifResults, o.sarif...) }
+	}
+	worst := runTasks(tasks, *jobs, collect)
+	if *sarif {
+		if err := writeSARIF(os.Stdout, sarifResults); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			worst = failed
+		}
+	}
+	switch {
+	case worst == failed:
+		os.Exit(exitError)
+	case worst == changed && *check:
+		os.Exit(exitNeedsRewrite)
+	}
+}
+
+// Returns the tasks for the files and directories in args.
+func findTasks(args []string, ig *ignorer) []task {
+	var tasks []task
+	skipped := func(path, reason string) {
+		if *verbose {
+			tasks = append(tasks, noteTask(fmt.Sprintf("skipping %s: %s", path, reason)))
+		}
+	}
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			tasks = append(tasks, errorTask(err))
+			continue
+		}
+		reason, err := ig.match(arg, info.IsDir())
+		if err != nil {
+			tasks = append(tasks, errorTask(err))
+			continue
+		} else if reason != "" {
+			skipped(arg, "ignored by "+reason)
+			continue
+		}
+		if info.IsDir() {
+			walkScripts(arg, ig, func(path string) {
+				tasks = append(tasks, fileTask(path))
+			}, func(err error) {
+				tasks = append(tasks, errorTask(err))
+			}, skipped)
+		} else {
+			tasks = append(tasks, fileTask(arg))
+		}
+	}
+	return tasks
+}
+
+// Returns the tasks for the Elvish scripts changed according to git, using args
+// as pathspecs.
+func findGitTasks(args []string, ig *ignorer) []task {
+	files, err := gitChangedFiles(*gitRef, *gitStaged, args)
+	if err != nil {
+		return []task{errorTask(err)}
+	}
+	var tasks []task
+	for _, name := range files {
+		reason, err := ig.match(name, false)
+		if err != nil {
+			tasks = append(tasks, errorTask(err))
+			continue
+		} else if reason != "" {
+			if *verbose {
+				tasks = append(tasks, noteTask(fmt.Sprintf("skipping %s: ignored by %s", name, reason)))
 			}
-			process(arg, f, w)
+			continue
+		}
+		if *gitStaged {
+			tasks = append(tasks, stagedFileTask(name))
+			continue
+		}
+		isScript, err := isElvishScriptFile(name)
+		if err != nil {
+			tasks = append(tasks, errorTask(err))
+		} else if isScript {
+			tasks = append(tasks, fileTask(name))
 		}
 	}
+	return tasks
 }
 
-func process(name string, r io.Reader, w io.Writer) {
-	code, err := io.ReadAll(r)
+func processStdin(o *output) status {
+	code, err := io.ReadAll(os.Stdin)
 	if err != nil {
-		diag.ShowError(os.Stderr, err)
-		return
+		o.showError(err)
+		return failed
+	}
+	// Rewriting is not possible with stdin; output to stdout instead.
+	return process(o, "[stdin]", code, nil)
+}
+
+func fileTask(name string) task {
+	return func(o *output) status {
+		code, err := os.ReadFile(name)
+		if err != nil {
+			o.showError(err)
+			return failed
+		}
+		write := func(fixed string) error {
+			return writeFile(name, code, []byte(fixed), *backup)
+		}
+		if sess != nil {
+			return sess.process(o, name, code, write)
+		}
+		return process(o, name, code, write)
+	}
+}
+
+func stagedFileTask(name string) task {
+	return func(o *output) status {
+		code, err := gitStagedContent(name)
+		if err != nil {
+			o.showError(err)
+			return failed
+		}
+		if !isElvishScript(name, code) {
+			return unchanged
+		}
+		// Rewriting the index is not supported.
+		return process(o, name, code, nil)
+	}
+}
+
+// Fixes the code, and writes the result to o according to the flags. The write
+// function is used to rewrite the source with -w; it is nil if the source can't
+// be rewritten.
+func process(o *output, name string, code []byte, write func(fixed string) error) status {
+	if chain != nil {
+		return processChain(o, name, string(code), write)
+	}
+	src := parse.Source{Name: name, Code: string(code)}
+	edits, err := fix.Edits(src, fixOpts)
+	if *jsonOut || *sarif {
+		if *jsonOut {
+			o.stdout.Write(marshalJSONLine(makeJSONFile(name, src.Code, edits, err)))
+		} else {
+			o.sarif = makeSARIFResults(name, src.Code, edits, err)
+		}
 	}
-	fixed, err := fix.Fix(parse.Source{Name: name, Code: string(code)}, fix.Opts{MigrateLambda: *lambda})
+	if err != nil && fix.GetError(err) == nil {
+		if !*jsonOut && !*sarif {
+			o.showError(err)
+		}
+		return failed
+	}
+	// With compilation errors, the forms with errors are left unmodified and
+	// the rest are still fixed. The errors are shown after the output.
+	st := emitFixed(o, name, src.Code, fix.Apply(src.Code, edits), write)
 	if err != nil {
-		diag.ShowError(os.Stderr, err)
+		if !*jsonOut && !*sarif {
+			o.showError(err)
+		}
+		return failed
+	}
+	return st
+}
+
+// Fixes the code in each step of the upgrade chain, parsing it and applying the
+// edits once per step, and writes the result to o like process. With -explain,
+// the rewrites of each step are listed instead of the result.
+func processChain(o *output, name, code string, write func(fixed string) error) status {
+	fixed := code
+	hasErrors := false
+	for _, step := range chain {
+		edits, err := fix.Edits(parse.Source{Name: name, Code: fixed}, step.Opts(fixOpts))
+		if err != nil && fix.GetError(err) == nil {
+			o.showError(err)
+			return failed
+		}
+		if *explain {
+			explainStep(o, name, fixed, step, edits)
+		}
+		fixed = fix.Apply(fixed, edits)
+		if err != nil {
+			// The positions are in the code of the step.
+			fmt.Fprintf(&o.stderr, "%s: errors when upgrading from %s to %s:\n", name, step.From, step.To)
+			o.showError(err)
+			hasErrors = true
+		}
+	}
+	st := emitFixed(o, name, code, fixed, write)
+	if hasErrors {
+		return failed
+	}
+	return st
+}
+
+// Lists the rewrites made by the edits in an upgrade step of the code, one line
+// for each rewrite, with the position of its first edit.
+func explainStep(o *output, name, code string, step fix.Step, edits []fix.Edit) {
+	fmt.Fprintf(&o.stdout, "%s: upgrading from %s to %s:", name, step.From, step.To)
+	if len(edits) == 0 {
+		fmt.Fprint(&o.stdout, " no changes\n")
 		return
 	}
-	if s, ok := w.(io.Seeker); ok {
-		s.Seek(0, io.SeekStart)
+	fmt.Fprintln(&o.stdout)
+	lines := newLineIndex(code)
+	explained := make(map[int]bool)
+	for _, edit := range edits {
+		if explained[edit.Rewrite] {
+			continue
+		}
+		explained[edit.Rewrite] = true
+		pos := lines.position(edit.From)
+		fmt.Fprintf(&o.stdout, "  %d:%d: %s [%s]\n", pos.Line, pos.Column, edit.Reason, edit.Rule)
+	}
+}
+
+// Writes the fixed code to o according to the flags, or rewrites the source
+// with write, and returns whether the code is changed. With -verify, code that
+// doesn't compile is not written; with -self-check, neither is code that
+// violates the invariants of fixing.
+func emitFixed(o *output, name, code, fixed string, write func(fixed string) error) status {
+	st := unchanged
+	if fixed != code {
+		st = changed
+	}
+	if *list && st == changed {
+		fmt.Fprintln(&o.stdout, name)
+	}
+	if *doDiff {
+		fmt.Fprint(&o.stdout, unifiedDiff(name+".orig", name, code, fixed))
+	}
+	if *patch {
+		diff, err := gitDiff(name, code, fixed)
+		if err != nil {
+			o.showError(err)
+			return failed
+		}
+		fmt.Fprint(&o.stdout, diff)
+	}
+	verified := !*verify || verifyFixed(o, name, code, fixed)
+	if *selfCheck && !runSelfCheck(o, name, code, fixed) {
+		verified = false
+	}
+	switch {
+	case *check:
+		// Don't output anything else.
+	case *rewrite && write != nil:
+		if st == changed && verified {
+			if err := write(fixed); err != nil {
+				o.showError(err)
+				return failed
+			}
+		}
+	case !*list && !*doDiff && !*patch && !*jsonOut && !*sarif && !*explain:
+		fmt.Fprint(&o.stdout, fixed)
+	}
+	if !verified {
+		return failed
+	}
+	return st
+}
+
+// Returns the options that disable the rules not in enable, if it is not
+// empty, and the rules in disable. Both are comma-separated lists of rule names.
+func parseRuleFlags(enable, disable string) (fix.Opts, error) {
+	disabled := make(map[fix.Rule]bool)
+	if enable != "" {
+		enabled, err := parseRuleList("-enable", enable)
+		if err != nil {
+			return fix.Opts{}, err
+		}
+		for _, rule := range fix.AllRules {
+			if !enabled[rule] {
+				disabled[rule] = true
+			}
+		}
+	}
+	if disable != "" {
+		more, err := parseRuleList("-disable", disable)
+		if err != nil {
+			return fix.Opts{}, err
+		}
+		for rule := range more {
+			disabled[rule] = true
+		}
+	}
+	return fix.Opts{DisabledRules: disabled}, nil
+}
+
+func parseRuleList(flagName, s string) (map[fix.Rule]bool, error) {
+	known := make(map[fix.Rule]bool)
+	for _, rule := range fix.AllRules {
+		known[rule] = true
+	}
+	rules := make(map[fix.Rule]bool)
+	for _, name := range strings.Split(s, ",") {
+		rule := fix.Rule(strings.TrimSpace(name))
+		if !known[rule] {
+			return nil, fmt.Errorf("%s: unknown rule %q; use -list-rules to see all rules", flagName, rule)
+		}
+		rules[rule] = true
+	}
+	return rules, nil
+}
+
+// Checks the examples of the pattern rules in opts, reporting the failures. It
+// returns the exit status.
+func checkRuleExamples(opts fix.Opts) int {
+	status := 0
+	for _, r := range opts.PatternRules {
+		if err := r.CheckExamples(opts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = exitError
+		}
+	}
+	return status
+}
+
+func contains(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+func countTrue(bs ...bool) int {
+	n := 0
+	for _, b := range bs {
+		if b {
+			n++
+		}
 	}
-	fmt.Fprint(w, fixed)
+	return n
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"src.elv.sh/pkg/diag"
+)
+
+// A task processes one source, writing to the given output.
+type task func(o *output) status
+
+// Buffered output of a task. Tasks may run in parallel, and their outputs are
+// emitted in the order of the tasks after they finish.
+type output struct {
+	stdout, stderr bytes.Buffer
+	// SARIF results, only collected with -sarif.
+	sarif []sarifResult
+}
+
+func (o *output) showError(err error) {
+	diag.ShowError(&o.stderr, err)
+}
+
+// Returns a task that only reports the given error.
+func errorTask(err error) task {
+	return func(o *output) status {
+		o.showError(err)
+		return failed
+	}
+}
+
+// Returns a task that only writes a note to stderr.
+func noteTask(msg string) task {
+	return func(o *output) status {
+		fmt.Fprintln(&o.stderr, msg)
+		return unchanged
+	}
+}
+
+// Runs the tasks on a pool of the given number of workers, and emits their
+// outputs in order. If collect is not nil, it is also called with the output of
+// each task in order. It returns the worst status of all the tasks.
+func runTasks(tasks []task, workers int, collect func(*output)) status {
+	worst := unchanged
+	emit := func(o *output, st status) {
+		os.Stdout.Write(o.stdout.Bytes())
+		os.Stderr.Write(o.stderr.Bytes())
+		if collect != nil {
+			collect(o)
+		}
+		if st > worst {
+			worst = st
+		}
+	}
+
+	if workers == 1 {
+		// Run the tasks in the current goroutine and emit the output of each
+		// task as soon as it finishes. Tasks that interact with the user rely
+		// on this.
+		for _, t := range tasks {
+			o := &output{}
+			emit(o, t(o))
+		}
+		return worst
+	}
+
+	outputs := make([]*output, len(tasks))
+	statuses := make([]status, len(tasks))
+	done := make([]chan struct{}, len(tasks))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	next := make(chan int)
+	go func() {
+		for i := range tasks {
+			next <- i
+		}
+		close(next)
+	}()
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range next {
+				o := &output{}
+				statuses[i] = tasks[i](o)
+				outputs[i] = o
+				close(done[i])
+			}
+		}()
+	}
+
+	for i := range tasks {
+		<-done[i]
+		emit(outputs[i], statuses[i])
+		// Release the output as soon as it has been emitted.
+		outputs[i] = nil
+	}
+	return worst
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Redirects os.Stdout and os.Stderr to files for the duration of the test, and
+// returns functions reading what has been written to them.
+func captureStdio(t *testing.T) (stdout, stderr func() string) {
+	dir := t.TempDir()
+	capture := func(p **os.File, name string) func() string {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := *p
+		*p = f
+		t.Cleanup(func() {
+			*p = old
+			f.Close()
+		})
+		return func() string { return mustReadFile(t, f.Name()) }
+	}
+	return capture(&os.Stdout, "stdout"), capture(&os.Stderr, "stderr")
+}
+
+func TestRunTasks_OutputInOrder(t *testing.T) {
+	const n = 20
+	var tasks []task
+	var want strings.Builder
+	for i := 0; i < n; i++ {
+		i := i
+		tasks = append(tasks, func(o *output) status {
+			// Earlier tasks take longer, so they finish out of order.
+			time.Sleep(time.Duration(n-i) * time.Millisecond)
+			fmt.Fprintf(&o.stdout, "out %d\n", i)
+			fmt.Fprintf(&o.stderr, "err %d\n", i)
+			if i == n/2 {
+				return failed
+			}
+			return changed
+		})
+		fmt.Fprintf(&want, "%d\n", i)
+	}
+
+	for _, workers := range []int{1, 4, n} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			stdout, stderr := captureStdio(t)
+			var collected strings.Builder
+			st := runTasks(tasks, workers, func(o *output) {
+				collected.WriteString(strings.TrimPrefix(o.stdout.String(), "out "))
+			})
+			if st != failed {
+				t.Errorf("got status %v, want %v", st, failed)
+			}
+			if got := collected.String(); got != want.String() {
+				t.Errorf("got outputs collected in order %q, want %q", got, want.String())
+			}
+			if got := stdout(); strings.ReplaceAll(got, "out ", "") != want.String() {
+				t.Errorf("got stdout %q, want the outputs in order", got)
+			}
+			if got := stderr(); strings.ReplaceAll(got, "err ", "") != want.String() {
+				t.Errorf("got stderr %q, want the outputs in order", got)
+			}
+		})
+	}
+}
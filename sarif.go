@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"path/filepath"
+
+	"github.com/elves/upgrade-scripts-for-0.17/fix"
+)
+
+// Types for a subset of SARIF 2.1.0, as specified in
+// https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html.
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool       sarifTool     `json:"tool"`
+	ColumnKind string        `json:"columnKind"`
+	Results    []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+	Help             sarifMessage `json:"help"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+	Fixes     []sarifFix      `json:"fixes,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine"`
+	EndColumn   int `json:"endColumn"`
+	ByteOffset  int `json:"byteOffset"`
+	ByteLength  int `json:"byteLength"`
+}
+
+type sarifFix struct {
+	Description     sarifMessage          `json:"description"`
+	ArtifactChanges []sarifArtifactChange `json:"artifactChanges"`
+}
+
+type sarifArtifactChange struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Replacements     []sarifReplacement    `json:"replacements"`
+}
+
+type sarifReplacement struct {
+	DeletedRegion   sarifRegion  `json:"deletedRegion"`
+	InsertedContent sarifMessage `json:"insertedContent"`
+}
+
+// Rule IDs for errors, in addition to the names of fix.Rule values.
+const (
+	sarifParseError       = "parse-error"
+	sarifCompilationError = "compilation-error"
+	sarifOtherError       = "error"
+)
+
+// All rules in the SARIF log. The rules from the fix package come first, so
+// that their indices are the same as in fix.AllRules.
+var sarifRules = makeSARIFRules()
+
+func makeSARIFRules() []sarifRule {
+	var rules []sarifRule
+	for _, r := range fix.AllRules {
+		rules = append(rules, sarifRule{
+			string(r), sarifMessage{r.Description()},
+			sarifMessage{r.Description() + " Fix with upgrade-scripts-for-0.17 -w."}})
+	}
+	rules = append(rules,
+		sarifRule{sarifParseError, sarifMessage{"Script can't be parsed."},
+			sarifMessage{"The script has syntax errors and can't be upgraded. Fix the errors and try again."}},
+		sarifRule{sarifCompilationError, sarifMessage{"Form can't be analyzed."},
+			sarifMessage{"The script contains a form that can't be analyzed, which is left unmodified. Fix the error and try again."}},
+		sarifRule{sarifOtherError, sarifMessage{"Script can't be processed."},
+			sarifMessage{"An error occurred when processing the script."}})
+	return rules
+}
+
+func sarifRuleIndex(id string) int {
+	for i, r := range sarifRules {
+		if r.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the SARIF results for the code in the named file, given the edits and
+// error returned by fix.Edits.
+func makeSARIFResults(name, code string, edits []fix.Edit, err error) []sarifResult {
+	artifact := sarifArtifactLocation{sarifURI(name)}
+	lines := newLineIndex(code)
+	var rewrites [][]fix.Edit
+	for _, edit := range edits {
+		for len(rewrites) <= edit.Rewrite {
+			rewrites = append(rewrites, nil)
+		}
+		rewrites[edit.Rewrite] = append(rewrites[edit.Rewrite], edit)
+	}
+	var results []sarifResult
+	for _, rw := range rewrites {
+		// Each rewrite is a result located at the span of its edits, with a
+		// single fix making all of them.
+		from, to := rw[0].From, rw[0].To
+		var replacements []sarifReplacement
+		for _, edit := range rw {
+			if edit.From < from {
+				from = edit.From
+			}
+			if edit.To > to {
+				to = edit.To
+			}
+			replacements = append(replacements, sarifReplacement{
+				lines.makeSARIFRegion(edit.From, edit.To), sarifMessage{edit.Text}})
+		}
+		results = append(results, sarifResult{
+			RuleID:    string(rw[0].Rule),
+			RuleIndex: sarifRuleIndex(string(rw[0].Rule)),
+			Level:     "warning",
+			Message:   sarifMessage{rw[0].Reason},
+			Locations: []sarifLocation{{sarifPhysicalLocation{artifact, lines.makeSARIFRegion(from, to)}}},
+			Fixes: []sarifFix{{sarifMessage{rw[0].Rule.Description()}, []sarifArtifactChange{{
+				artifact, replacements}}}},
+		})
+	}
+	if err == nil {
+		return results
+	}
+	entries := diagErrors(err)
+	if entries == nil {
+		return append(results, sarifResult{
+			RuleID:    sarifOtherError,
+			RuleIndex: sarifRuleIndex(sarifOtherError),
+			Level:     "error",
+			Message:   sarifMessage{err.Error()},
+			Locations: []sarifLocation{{sarifPhysicalLocation{
+				artifact, lines.makeSARIFRegion(0, 0)}}},
+		})
+	}
+	for _, e := range entries {
+		id := sarifCompilationError
+		if e.Type == "parse error" {
+			id = sarifParseError
+		}
+		ctxLines := newLineIndex(e.Context.Source)
+		results = append(results, sarifResult{
+			RuleID:    id,
+			RuleIndex: sarifRuleIndex(id),
+			Level:     "error",
+			Message:   sarifMessage{e.Message},
+			Locations: []sarifLocation{{sarifPhysicalLocation{
+				artifact, ctxLines.makeSARIFRegion(e.Context.From, e.Context.To)}}},
+		})
+	}
+	return results
+}
+
+func (li lineIndex) makeSARIFRegion(from, to int) sarifRegion {
+	start, end := li.position(from), li.position(to)
+	return sarifRegion{start.Line, start.Column, end.Line, end.Column, from, to - from}
+}
+
+// Converts a file name to a relative URI reference.
+func sarifURI(name string) string {
+	u := url.URL{Path: filepath.ToSlash(name)}
+	return u.String()
+}
+
+func writeSARIF(w io.Writer, results []sarifResult) error {
+	if results == nil {
+		results = []sarifResult{}
+	}
+	log := sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs: []sarifRun{{
+			Tool: sarifTool{sarifDriver{
+				Name:           "upgrade-scripts-for-0.17",
+				InformationURI: "https://github.com/elves/upgrade-scripts-for-0.17",
+				Rules:          sarifRules,
+			}},
+			ColumnKind: "unicodeCodePoints",
+			Results:    results,
+		}},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(log)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"path/filepath"
+	"testing"
+
+	"github.com/elves/upgrade-scripts-for-0.17/fix"
+	"src.elv.sh/pkg/parse"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// Code with a rewrite after non-ASCII text on its first line, a rewrite of two
+// edits spanning its second line, and a compilation error on its third line.
+const sarifTestCode = "echo αβ; a = 1\nfn f [x]{ }\nput (del $b)\n"
+
+func TestWriteSARIF_Golden(t *testing.T) {
+	var results []sarifResult
+	for _, file := range []struct{ name, code string }{
+		{"dir/a b.elv", sarifTestCode},
+		{"unparsable.elv", "echo (\n"},
+	} {
+		edits, err := fix.Edits(parse.Source{Name: file.name, Code: file.code}, fix.Opts{})
+		results = append(results, makeSARIFResults(file.name, file.code, edits, err)...)
+	}
+	var buf bytes.Buffer
+	if err := writeSARIF(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", "sarif.golden")
+	if *update {
+		mustWriteFile(t, golden, buf.String())
+	}
+	if want := mustReadFile(t, golden); buf.String() != want {
+		t.Errorf("got SARIF log:\n%s\nwant:\n%s\nrun go test -update to update the golden file", buf.String(), want)
+	}
+}
+
+func TestWriteSARIF_NoResults(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeSARIF(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`"results": []`)) {
+		t.Errorf("got SARIF log without an empty results array:\n%s", buf.String())
+	}
+}
+
+func TestSARIFRules_MatchFixRules(t *testing.T) {
+	for i, rule := range fix.AllRules {
+		if sarifRules[i].ID != string(rule) {
+			t.Errorf("got SARIF rule %q at index %d, want %q", sarifRules[i].ID, i, rule)
+		}
+	}
+}
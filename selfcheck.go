@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/elves/upgrade-scripts-for-0.17/fix"
+	"src.elv.sh/pkg/parse"
+)
+
+// Checks the invariants of fixing code into fixed, writing a bug report to o if
+// any of them fails. It returns whether all the invariants hold.
+func runSelfCheck(o *output, name, code, fixed string) bool {
+	problem := checkInvariants(name, code, fixed)
+	if problem == "" {
+		return true
+	}
+	fmt.Fprintf(&o.stderr, "%s: bug in upgrade-scripts-for-0.17: %s\n", name, problem)
+	fmt.Fprintf(&o.stderr, "Please report this bug with the following minimal input:\n%s\n",
+		minimizeInput(name, code))
+	return false
+}
+
+// Returns a description of the first invariant that fails when fixing code
+// into fixed, or an empty string if all of them hold:
+//
+// - Fixing the fixed code again makes no edits.
+//
+// - The fixed code can be parsed if the original code can.
+//
+// - The number of top-level forms is unchanged, not counting var forms that
+// only declare variables and use forms, which the fixes may add.
+//
+// - The number of lambdas is unchanged, not counting the lambdas the edits mark
+// as added, like those wrapping temporary assignments.
+func checkInvariants(name, code, fixed string) string {
+	edits, err := fix.Edits(parse.Source{Name: name, Code: fixed}, fixOpts)
+	if err != nil && fix.GetError(err) == nil && parse.GetError(err) == nil {
+		return "fixing the rewritten code again fails: " + err.Error()
+	}
+	if len(edits) > 0 {
+		noun := "edits"
+		if len(edits) == 1 {
+			noun = "edit"
+		}
+		return fmt.Sprintf("fixing the rewritten code again is not a no-op, making %d %s", len(edits), noun)
+	}
+	before, beforeErr := parse.Parse(parse.Source{Name: name, Code: code}, parse.Config{})
+	after, afterErr := parse.Parse(parse.Source{Name: name, Code: fixed}, parse.Config{})
+	if afterErr != nil {
+		if beforeErr == nil {
+			return "the rewritten code can't be parsed: " + afterErr.Error()
+		}
+		// The trees are incomplete and can't be compared.
+		return ""
+	}
+	if b, a := countTopLevelForms(before.Root), countTopLevelForms(after.Root); b != a {
+		return fmt.Sprintf("the number of top-level forms changed from %d to %d", b, a)
+	}
+	if b, a := countLambdas(before.Root)+countAddedLambdas(name, code), countLambdas(after.Root); b != a {
+		return fmt.Sprintf("the number of lambdas changed from %d to %d", b, a)
+	}
+	return ""
+}
+
+// Counts the top-level forms, except var forms that only declare variables and
+// use forms.
+func countTopLevelForms(n *parse.Chunk) int {
+	count := 0
+	for _, p := range n.Pipelines {
+		for _, f := range p.Forms {
+			if !isVarDeclaration(f) && !isUse(f) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func isVarDeclaration(f *parse.Form) bool {
+	if f.Head == nil || parse.SourceText(f.Head) != "var" {
+		return false
+	}
+	for _, arg := range f.Args {
+		if parse.SourceText(arg) == "=" {
+			return false
+		}
+	}
+	return true
+}
+
+func isUse(f *parse.Form) bool {
+	return f.Head != nil && parse.SourceText(f.Head) == "use"
+}
+
+func countLambdas(n parse.Node) int {
+	count := 0
+	if p, ok := n.(*parse.Primary); ok && p.Type == parse.Lambda {
+		count++
+	}
+	for _, ch := range parse.Children(n) {
+		count += countLambdas(ch)
+	}
+	return count
+}
+
+// Counts the lambdas that fixing code adds.
+func countAddedLambdas(name, code string) int {
+	edits, _ := fix.Edits(parse.Source{Name: name, Code: code}, fixOpts)
+	count := 0
+	for _, edit := range edits {
+		if edit.AddsLambda {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns the smallest input found that still violates the invariants, by
+// repeatedly removing top-level pipelines from the code.
+func minimizeInput(name, code string) string {
+	tree, err := parse.Parse(parse.Source{Name: name, Code: code}, parse.Config{})
+	if err != nil {
+		return code
+	}
+	var pipelines []string
+	for _, p := range tree.Root.Pipelines {
+		pipelines = append(pipelines, parse.SourceText(p))
+	}
+	fails := func(code string) bool {
+		fixed, err := fix.Fix(parse.Source{Name: name, Code: code}, fixOpts)
+		if err != nil && fix.GetError(err) == nil {
+			return false
+		}
+		return checkInvariants(name, code, fixed) != ""
+	}
+	for removed := true; removed; {
+		removed = false
+		for i := range pipelines {
+			candidate := append(append([]string(nil), pipelines[:i]...), pipelines[i+1:]...)
+			if fails(strings.Join(candidate, "\n")) {
+				pipelines = candidate
+				removed = true
+				break
+			}
+		}
+	}
+	minimal := strings.Join(pipelines, "\n")
+	if !fails(minimal) {
+		// Joining the pipelines with newlines changed the meaning of the code.
+		return code
+	}
+	return minimal
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"src.elv.sh/pkg/cli"
+	"src.elv.sh/pkg/edit"
+	"src.elv.sh/pkg/eval"
+	"src.elv.sh/pkg/parse"
+)
+
+// Deprecation level used with -verify, so that the deprecations of 0.17 are
+// reported.
+const verifyDeprecationLevel = 17
+
+// Checks the fixed code with the Elvish compiler, writing any error and
+// deprecation warnings to o. It returns false if the fixed code doesn't
+// compile while the original code doesn't have the same error; such code
+// should not be written.
+func verifyFixed(o *output, name, code, fixed string) bool {
+	var warnings bytes.Buffer
+	err := checkCode(name, fixed, &warnings)
+	o.stderr.Write(warnings.Bytes())
+	if err == nil {
+		return true
+	}
+	if fixed == code || sameError(err, checkCode(name, code, nil)) {
+		// Most likely the error is not caused by the rewrites, but since the
+		// compiler stops at the first error, the rest of the code is not
+		// checked.
+		fmt.Fprintf(&o.stderr, "%s: can't fully verify the rewritten code, since the original code has the same error:\n", name)
+		o.showError(err)
+		return true
+	}
+	fmt.Fprintf(&o.stderr, "%s: the rewritten code doesn't compile:\n", name)
+	o.showError(err)
+	return false
+}
+
+// Returns the first parse or compilation error of the code found by the Elvish
+// compiler. If w is not nil, deprecation warnings are written to it.
+func checkCode(name, code string, w io.Writer) error {
+	pe, ce := newVerifyEvaler().Check(parse.Source{Name: name, Code: code}, w)
+	if pe != nil {
+		return pe
+	}
+	if ce != nil {
+		return ce
+	}
+	return nil
+}
+
+// Returns an Evaler with the same builtins as an interactive Elvish shell,
+// including the edit: namespace, so that rc.elv files can be checked. The
+// editor is never started.
+func newVerifyEvaler() *eval.Evaler {
+	ev := eval.NewEvaler()
+	ed := edit.NewEditor(cli.NewTTY(os.Stdin, os.Stderr), ev, nil)
+	ev.AddBuiltin(eval.NsBuilder{}.AddNs("edit", ed.Ns()).Ns())
+	return ev
+}
+
+// Returns whether the errors have the same messages, ignoring the positions,
+// which are shifted by the rewrites.
+func sameError(a, b error) bool {
+	return b != nil && errorMessages(a) == errorMessages(b)
+}
+
+func errorMessages(err error) string {
+	var sb strings.Builder
+	for _, e := range diagErrors(err) {
+		sb.WriteString(e.Message + "\n")
+	}
+	return sb.String()
+}
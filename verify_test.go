@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"src.elv.sh/pkg/prog"
+)
+
+// Sets a flag for the duration of the test.
+func setFlag(t *testing.T, p *bool, v bool) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+func setDeprecationLevel(t *testing.T) {
+	old := prog.DeprecationLevel
+	prog.DeprecationLevel = verifyDeprecationLevel
+	t.Cleanup(func() { prog.DeprecationLevel = old })
+}
+
+var verifyFixedTests = []struct {
+	name        string
+	code, fixed string
+	ok          bool
+	// Substrings of the output to stderr; empty if there should be none.
+	stderr []string
+}{
+	{
+		name: "compiles", code: "a = 1", fixed: "var a = 1", ok: true,
+	},
+	{
+		name: "edit namespace", code: "edit:insert:binding", fixed: "put $edit:insert:binding", ok: true,
+	},
+	{
+		name: "doesn't compile", code: "echo $a", fixed: "echo $b", ok: false,
+		stderr: []string{"the rewritten code doesn't compile", "variable $b not found"},
+	},
+	{
+		name: "same error as original", code: "echo $a; a = 1", fixed: "echo $a; var a = 1", ok: true,
+		stderr: []string{"can't fully verify", "variable $a not found"},
+	},
+	{
+		name: "deprecation", code: "a = 1", fixed: "a = 1", ok: true,
+		stderr: []string{"legacy assignment form is deprecated"},
+	},
+}
+
+func TestVerifyFixed(t *testing.T) {
+	setDeprecationLevel(t)
+	for _, tc := range verifyFixedTests {
+		t.Run(tc.name, func(t *testing.T) {
+			var o output
+			if ok := verifyFixed(&o, "a.elv", tc.code, tc.fixed); ok != tc.ok {
+				t.Errorf("got %v, want %v", ok, tc.ok)
+			}
+			stderr := o.stderr.String()
+			if len(tc.stderr) == 0 && stderr != "" {
+				t.Errorf("got stderr %q, want none", stderr)
+			}
+			for _, s := range tc.stderr {
+				if !strings.Contains(stderr, s) {
+					t.Errorf("got stderr %q, want it to contain %q", stderr, s)
+				}
+			}
+		})
+	}
+}
+
+func TestEmitFixed_VerifyDoesNotWriteCodeThatDoesNotCompile(t *testing.T) {
+	setDeprecationLevel(t)
+	setFlag(t, verify, true)
+	setFlag(t, rewrite, true)
+	for _, tc := range []struct {
+		fixed  string
+		status status
+	}{
+		{"var a = 1", changed},
+		{"echo $b", failed},
+	} {
+		written := false
+		write := func(string) error {
+			written = true
+			return nil
+		}
+		st := emitFixed(&output{}, "a.elv", "a = 1", tc.fixed, write)
+		if st != tc.status || written != (tc.status == changed) {
+			t.Errorf("fixing to %q got status %v and written %v, want status %v",
+				tc.fixed, st, written, tc.status)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Maximum number of bytes read when looking for a shebang line.
+const maxShebangLen = 256
+
+// Walks the directory tree rooted at root, calling f with the path of each
+// Elvish script found, and report with each error encountered. Directories
+// named .git are skipped, and so are scripts and directories excluded by ig if
+// it is not nil; skipped is called with their paths and the reasons, like
+// "ignored by .gitignore:1".
+//
+// Elvish scripts are regular files with the .elv extension, or whose first
+// line is a shebang invoking elvish. Symbolic links are followed only if root
+// is one, which also means that symbolic link loops are not a problem.
+func walkScripts(root string, ig *ignorer, f func(path string), report func(error), skipped func(path, reason string)) {
+	if info, err := os.Lstat(root); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		// WalkDir doesn't follow root if it is a symbolic link; a trailing
+		// separator makes it do so, keeping the paths under the link.
+		root += string(filepath.Separator)
+	}
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			report(err)
+			return nil
+		}
+		if d.IsDir() {
+			if path != root && d.Name() == ".git" {
+				skipped(path, "git directory")
+				return filepath.SkipDir
+			}
+			if ig != nil {
+				reason, err := ig.match(path, true)
+				if err != nil {
+					report(err)
+				} else if reason != "" {
+					skipped(path, "ignored by "+reason)
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		isScript, err := isElvishScriptFile(path)
+		if err != nil {
+			report(err)
+			return nil
+		} else if !isScript {
+			return nil
+		}
+		if ig != nil {
+			reason, err := ig.match(path, false)
+			if err != nil {
+				report(err)
+				return nil
+			} else if reason != "" {
+				skipped(path, "ignored by "+reason)
+				return nil
+			}
+		}
+		f(path)
+		return nil
+	})
+}
+
+// Reports whether the named file is an Elvish script, either by its extension
+// or by its shebang line.
+func isElvishScriptFile(name string) (bool, error) {
+	if filepath.Ext(name) == ".elv" {
+		return true, nil
+	}
+	return hasElvishShebang(name)
+}
+
+// Like isElvishScriptFile, but uses the given content instead of reading the
+// file.
+func isElvishScript(name string, code []byte) bool {
+	if filepath.Ext(name) == ".elv" {
+		return true
+	}
+	if len(code) > maxShebangLen {
+		code = code[:maxShebangLen]
+	}
+	if i := bytes.IndexByte(code, '\n'); i != -1 {
+		code = code[:i]
+	}
+	return isElvishShebang(string(code))
+}
+
+// Reports whether the file starts with a shebang line invoking elvish, either
+// directly like "#!/usr/local/bin/elvish", or via env like
+// "#!/usr/bin/env elvish".
+func hasElvishShebang(name string) (bool, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	r := bufio.NewReaderSize(file, maxShebangLen)
+	line, err := r.ReadSlice('\n')
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return false, err
+	}
+	return isElvishShebang(string(line)), nil
+}
+
+func isElvishShebang(line string) bool {
+	if !strings.HasPrefix(line, "#!") {
+		return false
+	}
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 {
+		return false
+	}
+	interp := path.Base(fields[0])
+	if interp == "env" {
+		// Skip options to env, like -S.
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") {
+				interp = path.Base(field)
+				break
+			}
+		}
+	}
+	return interp == "elvish"
+}
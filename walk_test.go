@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWalkScripts(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.elv", ".hidden/b.elv", ".git/c.elv", "sub/d.elv", "sub/e.txt"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(filepath.Join(dir, "sub"), link); err != nil {
+		t.Skip("can't create symbolic links:", err)
+	}
+
+	walk := func(root string) (found, skipped []string) {
+		walkScripts(root, nil, func(path string) {
+			found = append(found, path)
+		}, func(err error) {
+			t.Errorf("got error %v", err)
+		}, func(path, reason string) {
+			skipped = append(skipped, path+": "+reason)
+		})
+		sort.Strings(found)
+		return found, skipped
+	}
+
+	found, skipped := walk(dir)
+	wantFound := []string{
+		filepath.Join(dir, ".hidden", "b.elv"), filepath.Join(dir, "a.elv"), filepath.Join(dir, "sub", "d.elv")}
+	if !reflect.DeepEqual(found, wantFound) {
+		t.Errorf("got scripts %q, want %q", found, wantFound)
+	}
+	if wantSkipped := []string{filepath.Join(dir, ".git") + ": git directory"}; !reflect.DeepEqual(skipped, wantSkipped) {
+		t.Errorf("got skipped %q, want %q", skipped, wantSkipped)
+	}
+
+	found, _ = walk(link)
+	if wantFound := []string{filepath.Join(link, "d.elv")}; !reflect.DeepEqual(found, wantFound) {
+		t.Errorf("got scripts %q under symbolic link, want %q", found, wantFound)
+	}
+}
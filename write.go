@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Writes data to the named file, replacing its content atomically. If
+// backupSuffix is non-empty, the original content, passed as orig, is saved to
+// a file whose name is the file name plus the suffix.
+//
+// The new content is first written to a temporary file in the same directory,
+// which is given the mode and ownership of the original file and then renamed
+// over it. As a result, the file is never left half-written. If the name
+// refers to a symbolic link, the file it points to is written instead.
+func writeFile(name string, orig, data []byte, backupSuffix string) error {
+	target, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file", name)
+	}
+	if backupSuffix != "" {
+		err := replaceFile(target+backupSuffix, orig, info)
+		if err != nil {
+			return err
+		}
+	}
+	return replaceFile(target, data, info)
+}
+
+// Atomically replaces the content of the named file with data, using the mode
+// and ownership in info.
+func replaceFile(name string, data []byte, info os.FileInfo) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(info.Mode()); err != nil {
+		return err
+	}
+	if err = chown(tmp, info); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func mustReadFile(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "a.elv")
+	mustWriteFile(t, name, "a = 1\n")
+	if err := os.Chmod(name, 0o750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFile(name, []byte("a = 1\n"), []byte("var a = 1\n"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustReadFile(t, name); got != "var a = 1\n" {
+		t.Errorf("got content %q, want %q", got, "var a = 1\n")
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0o750 {
+		t.Errorf("got mode %v, want %v", info.Mode().Perm(), os.FileMode(0o750))
+	}
+	// The temporary file is renamed over the original, so nothing is left
+	// behind.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("got files %q in the directory, want only a.elv", names)
+	}
+}
+
+func TestWriteFile_Backup(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "a.elv")
+	mustWriteFile(t, name, "a = 1\n")
+
+	if err := writeFile(name, []byte("a = 1\n"), []byte("var a = 1\n"), ".orig"); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustReadFile(t, name); got != "var a = 1\n" {
+		t.Errorf("got content %q, want %q", got, "var a = 1\n")
+	}
+	if got := mustReadFile(t, name+".orig"); got != "a = 1\n" {
+		t.Errorf("got backup %q, want %q", got, "a = 1\n")
+	}
+}
+
+func TestWriteFile_Symlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.elv")
+	mustWriteFile(t, target, "a = 1\n")
+	link := filepath.Join(dir, "link.elv")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip("can't create symbolic links:", err)
+	}
+
+	if err := writeFile(link, []byte("a = 1\n"), []byte("var a = 1\n"), ".orig"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("link replaced by a regular file, or removed (error %v)", err)
+	}
+	if got := mustReadFile(t, target); got != "var a = 1\n" {
+		t.Errorf("got target content %q, want %q", got, "var a = 1\n")
+	}
+	if got := mustReadFile(t, target+".orig"); got != "a = 1\n" {
+		t.Errorf("got backup of target %q, want %q", got, "a = 1\n")
+	}
+}
+
+func TestWriteFile_NotRegular(t *testing.T) {
+	if err := writeFile(t.TempDir(), nil, []byte("var a = 1\n"), ""); err == nil {
+		t.Errorf("got nil error writing a directory, want error")
+	}
+}